@@ -0,0 +1,737 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	roleAdmin    = "admin"
+	roleUser     = "user"
+	roleUploader = "uploader"
+	roleReader   = "reader"
+)
+
+// Roles in order of decreasing privilege.
+var roles = []string{roleAdmin, roleUser, roleUploader, roleReader}
+
+func validRole(role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// allow restricts a route to users with one of the given roles. It relies on
+// the role being set by the priv middleware.
+func allow(permitted ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		role := ctx.GetString("role")
+		for _, r := range permitted {
+			if r == role {
+				ctx.Next()
+				return
+			}
+		}
+
+		ctx.AbortWithStatus(http.StatusForbidden)
+	}
+}
+
+// mapRole returns the most privileged role that any of the groups is mapped
+// to, or an empty string if none of them is.
+func mapRole(groups []string, mapping map[string]string) string {
+	for _, r := range roles {
+		for _, g := range groups {
+			if mapping[g] == r {
+				return r
+			}
+		}
+	}
+	return ""
+}
+
+func assignRole(db *sql.DB, userid int, role string) error {
+	_, err := db.Exec(`
+		UPDATE user
+		SET role = ?
+		WHERE id = ?
+	`, role, userid)
+	return err
+}
+
+func registerAdmin(priv *gin.RouterGroup, db *sql.DB, c config, t *throttle) {
+	admin := priv.Group("/admin", allow(roleAdmin))
+
+	admin.GET("/", func(ctx *gin.Context) {
+		ctx.Redirect(http.StatusFound, "/admin/users/")
+	})
+
+	admin.GET("/users/", func(ctx *gin.Context) {
+		rows, err := db.Query(`
+			SELECT u.id, u.name, u.role, u.provider, u.disabled, COUNT(f.uuid), COALESCE(SUM(f.size), 0), u.quota
+			FROM user u
+			LEFT JOIN file f
+			ON f.owner_id = u.id
+			GROUP BY u.id
+			ORDER BY u.name
+		`)
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		defer func() {
+			err := rows.Close()
+			if err != nil {
+				log.Printf("Unable to close rows: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+		}()
+
+		var users []gin.H
+		for rows.Next() {
+			var (
+				id       int
+				name     string
+				role     string
+				provider sql.NullString
+				disabled bool
+				files    int
+				used     int64
+				quota    sql.NullInt64
+			)
+			if err := rows.Scan(&id, &name, &role, &provider, &disabled, &files, &used, &quota); err != nil {
+				log.Printf("Could not copy values from database: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+			user := gin.H{
+				"ID":       id,
+				"Name":     name,
+				"Role":     role,
+				"Provider": provider.String,
+				"Disabled": disabled,
+				"Files":    files,
+				"Used":     formatSize(used),
+				"Quota":    "",
+			}
+			if quota.Valid {
+				user["Quota"] = formatSize(quota.Int64)
+			}
+			users = append(users, user)
+		}
+		if err = rows.Err(); err != nil {
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		page(ctx, "users", gin.H{
+			"Users": users,
+			"Roles": roles,
+		})
+	})
+
+	// Actions on a user share the lookup of the target and the confirmation.
+	target := func(ctx *gin.Context, message func(name string) string) (int, bool) {
+		var in struct {
+			ID int `form:"id" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/admin/users/")
+			return 0, false
+		}
+
+		row := db.QueryRow(`
+			SELECT name
+			FROM user
+			WHERE id = ?
+		`, in.ID)
+
+		var name string
+		if err := row.Scan(&name); err != nil {
+			log.Printf("Could not copy values from database: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/admin/users/")
+			return 0, false
+		}
+
+		if !confirm(ctx, message(name)) {
+			return 0, false
+		}
+
+		return in.ID, true
+	}
+
+	// Administrators cannot lock themselves out.
+	self := func(ctx *gin.Context, userid int) bool {
+		if sessions.Default(ctx).Get("user_id") == userid {
+			log.Printf("Refusing to modify the current user")
+			ctx.Redirect(http.StatusFound, "/admin/users/")
+			return true
+		}
+		return false
+	}
+
+	admin.POST("/users/create", func(ctx *gin.Context) {
+		var in struct {
+			Name     string `form:"name" binding:"required"`
+			Password string `form:"password" binding:"required"`
+			Role     string `form:"role" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/admin/users/")
+			return
+		}
+
+		if !confirm(ctx, fmt.Sprintf("Create %s as %s?", in.Name, in.Role)) {
+			return
+		}
+
+		if _, err := createUser(db, in.Name, in.Password, in.Role); err != nil {
+			log.Printf("Unable to create user: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/admin/users/")
+	})
+
+	admin.POST("/users/role", func(ctx *gin.Context) {
+		role := ctx.PostForm("role")
+		if !validRole(role) {
+			ctx.Redirect(http.StatusFound, "/admin/users/")
+			return
+		}
+
+		userid, ok := target(ctx, func(name string) string {
+			return fmt.Sprintf("Change the role of %s to %s?", name, role)
+		})
+		if !ok || self(ctx, userid) {
+			return
+		}
+
+		if err := assignRole(db, userid, role); err != nil {
+			log.Printf("Unable to update role: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/admin/users/")
+	})
+
+	admin.POST("/users/rename", func(ctx *gin.Context) {
+		rename := ctx.PostForm("name")
+
+		userid, ok := target(ctx, func(name string) string {
+			return fmt.Sprintf("Rename %s to %s?", name, rename)
+		})
+		if !ok {
+			return
+		}
+
+		if err := renameUser(db, userid, rename); err != nil {
+			log.Printf("Unable to rename user: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/admin/users/")
+	})
+
+	admin.POST("/users/password", func(ctx *gin.Context) {
+		userid, ok := target(ctx, func(name string) string {
+			return fmt.Sprintf("Reset the password of %s and sign them out everywhere?", name)
+		})
+		if !ok {
+			return
+		}
+
+		if err := resetPassword(db, userid, ctx.PostForm("password")); err != nil {
+			log.Printf("Unable to reset password: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/admin/users/")
+	})
+
+	admin.POST("/users/disable", func(ctx *gin.Context) {
+		disabled := ctx.PostForm("disabled") == "1"
+
+		userid, ok := target(ctx, func(name string) string {
+			if disabled {
+				return fmt.Sprintf("Disable %s and sign them out everywhere?", name)
+			}
+			return fmt.Sprintf("Enable %s?", name)
+		})
+		if !ok || self(ctx, userid) {
+			return
+		}
+
+		if err := disableUser(db, userid, disabled); err != nil {
+			log.Printf("Unable to update user: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/admin/users/")
+	})
+
+	admin.POST("/users/quota", func(ctx *gin.Context) {
+		var quota sql.NullInt64
+		if q := ctx.PostForm("quota"); q != "" {
+			n, err := parseSize(q)
+			if err != nil {
+				ctx.Redirect(http.StatusFound, "/admin/users/")
+				return
+			}
+			quota = sql.NullInt64{
+				Int64: n,
+				Valid: true,
+			}
+		}
+
+		userid, ok := target(ctx, func(name string) string {
+			if quota.Valid {
+				return fmt.Sprintf("Limit the files of %s to %s?", name, formatSize(quota.Int64))
+			}
+			return fmt.Sprintf("Remove the quota of %s?", name)
+		})
+		if !ok {
+			return
+		}
+
+		if err := setQuota(db, userid, quota); err != nil {
+			log.Printf("Unable to update quota: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/admin/users/")
+	})
+
+	admin.POST("/users/delete", func(ctx *gin.Context) {
+		// Files are only deleted if that has been chosen explicitly, so an
+		// heir which cannot be found stops the deletion.
+		var heir sql.NullInt64
+		if v := ctx.PostForm("heir"); v != "" {
+			h, err := strconv.Atoi(v)
+			if err != nil {
+				ctx.Redirect(http.StatusFound, "/admin/users/")
+				return
+			}
+
+			var exists bool
+			err = db.QueryRow(`
+				SELECT EXISTS (
+					SELECT 1
+					FROM user
+					WHERE id = ?
+				)
+			`, h).Scan(&exists)
+			if err != nil || !exists {
+				ctx.Redirect(http.StatusFound, "/admin/users/")
+				return
+			}
+
+			heir = sql.NullInt64{
+				Int64: int64(h),
+				Valid: true,
+			}
+		}
+
+		userid, ok := target(ctx, func(name string) string {
+			if heir.Valid {
+				return fmt.Sprintf("Delete %s and hand their files over?", name)
+			}
+			return fmt.Sprintf("Delete %s along with all of their files?", name)
+		})
+		if !ok || self(ctx, userid) {
+			return
+		}
+
+		if err := deleteUser(db, c.Data, userid, heir); err != nil {
+			log.Printf("Unable to delete user: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/admin/users/")
+	})
+
+	api := priv.Group("/api/admin", allow(roleAdmin))
+
+	api.GET("/users", func(ctx *gin.Context) {
+		rows, err := db.Query(`
+			SELECT id, name, role, provider, disabled
+			FROM user
+			ORDER BY name
+		`)
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.JSON(500, gin.H{
+				"error": "Could not query database",
+			})
+			return
+		}
+		defer rows.Close()
+
+		users := []gin.H{}
+		for rows.Next() {
+			var (
+				id       int
+				name     string
+				role     string
+				provider sql.NullString
+				disabled bool
+			)
+			if err := rows.Scan(&id, &name, &role, &provider, &disabled); err != nil {
+				log.Printf("Could not copy values from database: %s", err.Error())
+				ctx.JSON(500, gin.H{
+					"error": "Could not copy values from database",
+				})
+				return
+			}
+			users = append(users, gin.H{
+				"id":       id,
+				"name":     name,
+				"role":     role,
+				"provider": provider.String,
+				"disabled": disabled,
+			})
+		}
+		if err = rows.Err(); err != nil {
+			ctx.JSON(500, gin.H{
+				"error": "Error encountered during iteration",
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, users)
+	})
+
+	api.POST("/users", func(ctx *gin.Context) {
+		var in struct {
+			Name     string `json:"name" binding:"required"`
+			Password string `json:"password" binding:"required"`
+			Role     string `json:"role"`
+		}
+		err := ctx.ShouldBindJSON(&in)
+		if err != nil {
+			ctx.JSON(400, gin.H{
+				"error": "Malformed input",
+			})
+			return
+		}
+
+		if in.Role == "" {
+			in.Role = roleUser
+		}
+
+		id, err := createUser(db, in.Name, in.Password, in.Role)
+		if err != nil {
+			log.Printf("Unable to create user: %s", err.Error())
+			ctx.JSON(400, gin.H{
+				"error": "Unable to create user",
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusCreated, gin.H{
+			"id": id,
+		})
+	})
+
+	api.PATCH("/users/:id", func(ctx *gin.Context) {
+		userid, err := strconv.Atoi(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(400, gin.H{
+				"error": "Malformed user ID",
+			})
+			return
+		}
+
+		var in struct {
+			Name     *string `json:"name"`
+			Password *string `json:"password"`
+			Role     *string `json:"role"`
+			Disabled *bool   `json:"disabled"`
+		}
+		err = ctx.ShouldBindJSON(&in)
+		if err != nil {
+			ctx.JSON(400, gin.H{
+				"error": "Malformed input",
+			})
+			return
+		}
+
+		if (in.Role != nil || in.Disabled != nil) && sessions.Default(ctx).Get("user_id") == userid {
+			ctx.JSON(400, gin.H{
+				"error": "Cannot modify the current user",
+			})
+			return
+		}
+
+		if in.Role != nil && !validRole(*in.Role) {
+			ctx.JSON(400, gin.H{
+				"error": "Invalid role",
+			})
+			return
+		}
+
+		var errs []error
+		if in.Name != nil {
+			errs = append(errs, renameUser(db, userid, *in.Name))
+		}
+		if in.Password != nil {
+			errs = append(errs, resetPassword(db, userid, *in.Password))
+		}
+		if in.Role != nil {
+			errs = append(errs, assignRole(db, userid, *in.Role))
+		}
+		if in.Disabled != nil {
+			errs = append(errs, disableUser(db, userid, *in.Disabled))
+		}
+
+		if err := errors.Join(errs...); errors.Is(err, errNoUser) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": "No such user",
+			})
+			return
+		} else if err != nil {
+			log.Printf("Unable to update user: %s", err.Error())
+			ctx.JSON(400, gin.H{
+				"error": "Unable to update user",
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{})
+	})
+
+	api.DELETE("/users/:id", func(ctx *gin.Context) {
+		userid, err := strconv.Atoi(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(400, gin.H{
+				"error": "Malformed user ID",
+			})
+			return
+		}
+
+		if sessions.Default(ctx).Get("user_id") == userid {
+			ctx.JSON(400, gin.H{
+				"error": "Cannot delete the current user",
+			})
+			return
+		}
+
+		var heir sql.NullInt64
+		if name := ctx.Query("heir"); name != "" {
+			h, err := lookupUser(db, name)
+			if err != nil {
+				ctx.JSON(400, gin.H{
+					"error": "Unknown heir",
+				})
+				return
+			}
+			heir = sql.NullInt64{
+				Int64: int64(h),
+				Valid: true,
+			}
+		}
+
+		if err := deleteUser(db, c.Data, userid, heir); errors.Is(err, errNoUser) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": "No such user",
+			})
+			return
+		} else if err != nil {
+			log.Printf("Unable to delete user: %s", err.Error())
+			ctx.JSON(400, gin.H{
+				"error": "Unable to delete user",
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{})
+	})
+
+	admin.GET("/files/", func(ctx *gin.Context) {
+		rows, err := db.Query(`
+			SELECT f.uuid, f.name, f.expiry, f.password IS NOT NULL, u.name
+			FROM file f
+			JOIN user u
+			ON f.owner_id = u.id
+			WHERE f.done
+			ORDER BY f.expiry
+		`)
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		defer func() {
+			err := rows.Close()
+			if err != nil {
+				log.Printf("Unable to close rows: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+		}()
+
+		_, active := t.downloading()
+
+		var files []gin.H
+		for rows.Next() {
+			var (
+				fileuuid  string
+				filename  string
+				expiry    int64
+				protected bool
+				owner     string
+			)
+			if err := rows.Scan(&fileuuid, &filename, &expiry, &protected, &owner); err != nil {
+				log.Printf("Could not copy values from database: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+			files = append(files, gin.H{
+				"UUID":      fileuuid,
+				"Name":      filename,
+				"Expiry":    time.Unix(expiry, 0),
+				"Protected": protected,
+				"Owner":     owner,
+				"Active":    active[fileuuid],
+			})
+		}
+		if err = rows.Err(); err != nil {
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		for _, file := range files {
+			file["Link"], err = firstLink(db, file["UUID"].(string))
+			if err != nil {
+				log.Printf("Could not query database: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+		}
+
+		page(ctx, "everything", gin.H{
+			"Files": files,
+		})
+	})
+
+	admin.POST("/files/delete", func(ctx *gin.Context) {
+		var in struct {
+			UUID string `form:"uuid" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/admin/files/")
+			return
+		}
+
+		// Only delete files which exist, as the UUID ends up in a path.
+		row := db.QueryRow(`
+			SELECT uuid
+			FROM file
+			WHERE uuid = ?
+		`, in.UUID)
+
+		var fileuuid string
+		if err := row.Scan(&fileuuid); errors.Is(err, sql.ErrNoRows) {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Could not get file from database: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/admin/files/")
+			return
+		}
+
+		remove(fileuuid, c.Data, db)
+
+		ctx.Redirect(http.StatusFound, "/admin/files/")
+	})
+
+	admin.POST("/files/extend", func(ctx *gin.Context) {
+		var in struct {
+			UUID string `form:"uuid" binding:"required"`
+			Time int64  `form:"time" binding:"required"`
+			Unit string `form:"unit" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/admin/files/")
+			return
+		}
+
+		add, err := asUnit(in.Unit, time.Duration(in.Time))
+		if err != nil || add <= 0 {
+			ctx.Redirect(http.StatusFound, "/admin/files/")
+			return
+		}
+
+		row := db.QueryRow(`
+			SELECT expiry
+			FROM file
+			WHERE uuid = ?
+			AND done
+		`, in.UUID)
+
+		var expiry int64
+		if err := row.Scan(&expiry); err != nil {
+			log.Printf("Could not get expiry from database: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/admin/files/")
+			return
+		}
+
+		now := time.Now()
+		extended := time.Unix(expiry, 0).Add(add)
+
+		if extended.After(now.Add(time.Duration(24*365) * time.Hour)) {
+			ctx.Redirect(http.StatusFound, "/admin/files/")
+			return
+		}
+
+		// The pending removal notices the new expiry once it fires.
+		_, err = db.Exec(`
+			UPDATE file
+			SET expiry = ?
+			WHERE uuid = ?
+		`, extended.Unix(), in.UUID)
+		if err != nil {
+			log.Printf("Unable to update expiry: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/admin/files/")
+	})
+}
+
+// confirm renders a page asking to confirm a form submission, which resubmits
+// the form once confirmed.
+func confirm(ctx *gin.Context, message string) bool {
+	if ctx.PostForm("confirm") == "yes" {
+		return true
+	}
+
+	fields := map[string]string{}
+	for k, v := range ctx.Request.PostForm {
+		if k != "confirm" && len(v) > 0 {
+			fields[k] = v[0]
+		}
+	}
+
+	page(ctx, "confirm", gin.H{
+		"Message": message,
+		"Action":  ctx.Request.URL.Path,
+		"Fields":  fields,
+	})
+
+	return false
+}
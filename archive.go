@@ -0,0 +1,388 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Archive formats whose contents can be listed.
+const (
+	formatZip    = "zip"
+	formatTar    = "tar"
+	formatTarGz  = "tar.gz"
+	formatTarZst = "tar.zst"
+)
+
+const (
+	// Listing stops after this many entries.
+	maxEntries = 10000
+
+	// Compressed data may expand to this many times its size plus
+	// minExpansion before it is considered to be an archive bomb.
+	maxRatio     = 100
+	minExpansion = 64 << 20
+
+	// Listing a tar archive means reading all of it, so it stops after this
+	// many bytes, however well the archive is compressed.
+	maxListing = 64 << 20
+)
+
+var errBomb = errors.New("archive expands too much")
+
+type archiveEntry struct {
+	Index    int
+	Name     string
+	Size     string
+	Modified time.Time
+	Regular  bool
+}
+
+// budget fails once more than n bytes have been read through it.
+type budget struct {
+	r io.Reader
+	n int64
+}
+
+func (b *budget) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n -= int64(n)
+	if b.n < 0 {
+		return n, errBomb
+	}
+	return n, err
+}
+
+func expansion(compressed int64) int64 {
+	return compressed*maxRatio + minExpansion
+}
+
+// cleanEntryName turns the name of an entry into a relative path, so that
+// names such as "../../etc/passwd" cannot escape wherever the entry ends up.
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, "\\", "/")), "/")
+}
+
+// archiveFormat determines the format of an archive from its first bytes.
+// Compressed files only count as archives if they contain a tar archive.
+func archiveFormat(p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	head = head[:n]
+
+	var format string
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return formatZip, nil
+	case isTar(head):
+		return formatTar, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		format = formatTarGz
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		format = formatTarZst
+	default:
+		return "", nil
+	}
+
+	r, closer, err := decompress(file, format, int64(n))
+	if err != nil {
+		return "", nil
+	}
+	defer closer()
+
+	head = make([]byte, 512)
+	if _, err := io.ReadFull(r, head); err != nil || !isTar(head) {
+		return "", nil
+	}
+
+	return format, nil
+}
+
+func isTar(head []byte) bool {
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+// decompress returns a reader for the tar archive inside a file, which is read
+// from the start.
+func decompress(file *os.File, format string, size int64) (io.Reader, func(), error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	r := bufio.NewReader(file)
+	switch format {
+	case formatTar:
+		return r, func() {}, nil
+	case formatTarGz:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &budget{r: gr, n: expansion(size)}, func() { gr.Close() }, nil
+	case formatTarZst:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return &budget{r: zr, n: expansion(size)}, zr.Close, nil
+	default:
+		return nil, nil, errors.New("unknown archive format")
+	}
+}
+
+// listArchive returns the entries of an archive. If there are too many of them,
+// the archive is too large to be read through or it turns out to be a bomb, the
+// entries found so far are returned and the listing is marked as truncated.
+func listArchive(p string, format string) ([]archiveEntry, bool, error) {
+	if format == formatZip {
+		zr, err := zip.OpenReader(p)
+		if err != nil {
+			return nil, false, err
+		}
+		defer zr.Close()
+
+		var entries []archiveEntry
+		for i, f := range zr.File {
+			if i == maxEntries {
+				return entries, true, nil
+			}
+			entries = append(entries, archiveEntry{
+				Index:    i,
+				Name:     cleanEntryName(f.Name),
+				Size:     formatSize(int64(f.UncompressedSize64)),
+				Modified: f.Modified,
+				Regular:  f.Mode().IsRegular(),
+			})
+		}
+		return entries, false, nil
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+
+	r, closer, err := decompress(file, format, info.Size())
+	if err != nil {
+		return nil, false, err
+	}
+	defer closer()
+
+	tr := tar.NewReader(&budget{r: r, n: maxListing})
+
+	var entries []archiveEntry
+	for i := 0; ; i++ {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, false, nil
+		}
+		if errors.Is(err, errBomb) || i == maxEntries {
+			return entries, true, nil
+		}
+		if err != nil {
+			return entries, true, err
+		}
+
+		entries = append(entries, archiveEntry{
+			Index:    i,
+			Name:     cleanEntryName(header.Name),
+			Size:     formatSize(header.Size),
+			Modified: header.ModTime,
+			Regular:  header.Typeflag == tar.TypeReg,
+		})
+	}
+}
+
+// sendEntry streams a single regular file out of an archive.
+func sendEntry(ctx *gin.Context, p string, format string, index int) error {
+	var (
+		name string
+		r    io.Reader
+	)
+
+	if format == formatZip {
+		zr, err := zip.OpenReader(p)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		if index < 0 || index >= len(zr.File) || !zr.File[index].Mode().IsRegular() {
+			return os.ErrNotExist
+		}
+
+		f := zr.File[index]
+		if f.UncompressedSize64 > uint64(expansion(int64(f.CompressedSize64))) {
+			return errBomb
+		}
+
+		// The zip reader fails if an entry is larger than it claims to be.
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		name, r = f.Name, rc
+	} else {
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		dr, closer, err := decompress(file, format, info.Size())
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		tr := tar.NewReader(dr)
+		for i := 0; ; i++ {
+			header, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				return os.ErrNotExist
+			}
+			if err != nil {
+				return err
+			}
+			if i < index {
+				continue
+			}
+			if header.Typeflag != tar.TypeReg {
+				return os.ErrNotExist
+			}
+
+			name, r = header.Name, tr
+			break
+		}
+	}
+
+	ctx.Header("Content-Type", "application/octet-stream")
+	ctx.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": path.Base(cleanEntryName(name)),
+	}))
+	ctx.Status(http.StatusOK)
+
+	_, err := io.Copy(ctx.Writer, r)
+	return err
+}
+
+func registerArchives(router *gin.Engine, db *sql.DB, c config, t *throttle) {
+	router.GET("/downloads/:id/entries/:index", func(ctx *gin.Context) {
+		id := ctx.Param("id")
+
+		l, err := lookupLink(db, id)
+		if err != nil {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+		fileuuid := l.File
+
+		row := db.QueryRow(`
+			SELECT password, max_downloads IS NOT NULL
+			FROM file
+			WHERE uuid = ?
+			AND done
+		`, fileuuid)
+
+		var (
+			password sql.NullString
+			limited  bool
+		)
+		if err := row.Scan(&password, &limited); err != nil {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+		// The password of a link replaces the one of the file.
+		if l.Password.Valid {
+			password = l.Password
+		}
+		limited = limited || l.MaxDownloads.Valid
+
+		session := sessions.Default(ctx)
+		permission, err := access(db, fileuuid, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to check access: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		if permission == "" && password.Valid && !linkUnlocked(session, id) {
+			ctx.Redirect(http.StatusFound, "/downloads/"+id)
+			return
+		}
+
+		// Entries would allow getting around the download limit.
+		if limited {
+			ctx.Redirect(http.StatusFound, "/downloads/"+id)
+			return
+		}
+
+		index, err := strconv.Atoi(ctx.Param("index"))
+		if err != nil {
+			ctx.Redirect(http.StatusFound, "/downloads/"+id)
+			return
+		}
+
+		p := filepath.Join(c.Data, fileuuid)
+
+		format, err := archiveFormat(p)
+		if err != nil || format == "" {
+			ctx.Redirect(http.StatusFound, "/downloads/"+id)
+			return
+		}
+
+		done, ok := t.begin(ctx, fileuuid)
+		if !ok {
+			return
+		}
+		defer done()
+
+		if err := sendEntry(ctx, p, format, index); err != nil {
+			log.Printf("Unable to send archive entry: %s", err.Error())
+			if !ctx.Writer.Written() {
+				ctx.Redirect(http.StatusFound, "/downloads/"+id)
+			}
+		}
+	})
+}
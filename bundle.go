@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Ways of bundling the files of a folder upload.
+const (
+	bundleCollection = "collection"
+	bundleZip        = "zip"
+)
+
+var errBundle = errors.New("files cannot be bundled")
+
+// parts describes the files which have been uploaded for a bundle. They all
+// have the same password or none, and are kept as long as the longest lasting
+// one.
+type parts struct {
+	Entries  []zipEntry
+	Expiry   time.Time
+	Password sql.NullString
+	Size     int64
+}
+
+// lookupParts checks that the files can be bundled. Since every file has a hash
+// of its own, the password they were uploaded with is checked against each of
+// them.
+func lookupParts(db *sql.DB, owner interface{}, files []string, password string) (parts, error) {
+	var p parts
+	seen := map[string]bool{}
+	for _, fileuuid := range files {
+		if seen[fileuuid] {
+			continue
+		}
+		seen[fileuuid] = true
+
+		row := db.QueryRow(`
+			SELECT name, expiry, password, size
+			FROM file
+			WHERE uuid = ?
+			AND owner_id = ?
+			AND done
+		`, fileuuid, owner)
+
+		var (
+			e      = zipEntry{UUID: fileuuid}
+			expiry int64
+			hash   sql.NullString
+			size   int64
+		)
+		if err := row.Scan(&e.Name, &expiry, &hash, &size); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return parts{}, errBundle
+			}
+			return parts{}, err
+		}
+
+		if hash.Valid != (password != "") {
+			return parts{}, errBundle
+		}
+		if hash.Valid {
+			if err := bcrypt.CompareHashAndPassword([]byte(hash.String), []byte(password)); err != nil {
+				return parts{}, errBundle
+			}
+		}
+
+		if len(p.Entries) == 0 {
+			p.Password = hash
+		}
+		p.Size += size
+		if t := time.Unix(expiry, 0); t.After(p.Expiry) {
+			p.Expiry = t
+		}
+		p.Entries = append(p.Entries, e)
+	}
+
+	if len(p.Entries) == 0 {
+		return parts{}, errBundle
+	}
+
+	return p, nil
+}
+
+// bundle replaces the given files with a single zip archive containing them.
+// The archive has to fit into the quota next to the files, since they are only
+// removed once it has been written.
+func (u *uploader) bundle(owner interface{}, name string, files []string, password string) (string, error) {
+	p, err := lookupParts(u.db, owner, files, password)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkQuota(u.db, owner, p.Size); err != nil {
+		return "", err
+	}
+
+	fileuuid := uuid.New().String()
+
+	dst, err := os.Create(filepath.Join(u.data, fileuuid))
+	if err != nil {
+		return "", err
+	}
+
+	err = writeZip(dst, u.data, p.Entries)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filepath.Join(u.data, fileuuid))
+		return "", err
+	}
+
+	info, err := os.Stat(filepath.Join(u.data, fileuuid))
+	if err == nil {
+		err = checkQuota(u.db, owner, info.Size())
+	}
+	if err != nil {
+		os.Remove(filepath.Join(u.data, fileuuid))
+		return "", err
+	}
+
+	err = u.insert(fileuuid, upload{
+		Name:     name + ".zip",
+		Expiry:   p.Expiry,
+		Password: p.Password,
+		Owner:    owner,
+	}, true, info.Size())
+	if err != nil {
+		os.Remove(filepath.Join(u.data, fileuuid))
+		return "", err
+	}
+
+	u.complete(fileuuid, p.Expiry)
+
+	for _, e := range p.Entries {
+		remove(e.UUID, u.data, u.db)
+	}
+
+	return fileuuid, nil
+}
+
+// bundleInCollection puts the given files into a new collection.
+func bundleInCollection(db *sql.DB, owner interface{}, name string, files []string, password string) (string, error) {
+	p, err := lookupParts(db, owner, files, password)
+	if err != nil {
+		return "", err
+	}
+
+	collectionuuid, err := createCollection(db, name, owner, p.Expiry, p.Password)
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range p.Entries {
+		_, err := db.Exec(`
+			INSERT OR IGNORE INTO collection_file (collection_uuid, file_uuid)
+			VALUES (?, ?)
+		`, collectionuuid, e.UUID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return collectionuuid, nil
+}
+
+func registerBundles(priv *gin.RouterGroup, db *sql.DB, up *uploader) {
+	// Bundle the files of a folder upload once all of them have been finished.
+	priv.POST("/bundle", allow(roleAdmin, roleUser, roleUploader), func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			Kind     string   `json:"kind" binding:"required"`
+			Name     string   `json:"name" binding:"required"`
+			Files    []string `json:"files" binding:"required"`
+			Password *string  `json:"password"`
+		}
+		err := ctx.ShouldBindJSON(&in)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.JSON(400, gin.H{
+				"error": "Malformed input",
+			})
+			return
+		}
+
+		var password string
+		if in.Password != nil {
+			password = *in.Password
+		}
+
+		var result gin.H
+		switch in.Kind {
+		case bundleCollection:
+			// Uploaders cannot manage collections.
+			if ctx.GetString("role") == roleUploader {
+				ctx.JSON(http.StatusForbidden, gin.H{
+					"error": "Not allowed to create collections",
+				})
+				return
+			}
+
+			var collectionuuid string
+			collectionuuid, err = bundleInCollection(db, session.Get("user_id"), in.Name, in.Files, password)
+			result = gin.H{
+				"collection": collectionuuid,
+			}
+		case bundleZip:
+			var fileuuid string
+			fileuuid, err = up.bundle(session.Get("user_id"), in.Name, in.Files, password)
+			result = gin.H{
+				"uuid": fileuuid,
+			}
+		default:
+			ctx.JSON(400, gin.H{
+				"error": "Unknown kind of bundle",
+			})
+			return
+		}
+
+		if errors.Is(err, errBundle) {
+			ctx.JSON(400, gin.H{
+				"error": "Files cannot be bundled",
+			})
+			return
+		}
+		if errors.Is(err, errQuota) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": "Quota exceeded",
+			})
+			return
+		}
+		if err != nil {
+			log.Printf("Unable to bundle files: %s", err.Error())
+			ctx.JSON(500, gin.H{
+				"error": "Unable to bundle files",
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusCreated, result)
+	})
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/google/uuid"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// collection groups files under a single share link, which has its own
+// password and expiry.
+type collection struct {
+	UUID     string
+	Name     string
+	Owner    int
+	Expiry   time.Time
+	Password sql.NullString
+}
+
+func lookupCollection(db *sql.DB, collectionuuid string) (collection, error) {
+	row := db.QueryRow(`
+		SELECT uuid, name, owner_id, expiry, password
+		FROM collection
+		WHERE uuid = ?
+		AND expiry > ?
+	`, collectionuuid, time.Now().Unix())
+
+	var (
+		col    collection
+		expiry int64
+	)
+	if err := row.Scan(&col.UUID, &col.Name, &col.Owner, &expiry, &col.Password); err != nil {
+		return collection{}, err
+	}
+	col.Expiry = time.Unix(expiry, 0)
+
+	return col, nil
+}
+
+func createCollection(db *sql.DB, name string, owner interface{}, expiry time.Time, password sql.NullString) (string, error) {
+	collectionuuid := uuid.New().String()
+
+	_, err := db.Exec(`
+		INSERT INTO collection (uuid, name, owner_id, expiry, password, created)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, collectionuuid, name, owner, expiry.Unix(), password, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+
+	watchCollection(collectionuuid, expiry, db)
+
+	return collectionuuid, nil
+}
+
+// members returns the finished files of a collection.
+func members(db *sql.DB, collectionuuid string) ([]zipEntry, error) {
+	rows, err := db.Query(`
+		SELECT f.uuid, f.name, f.password IS NOT NULL
+		FROM collection_file m
+		JOIN file f
+		ON m.file_uuid = f.uuid
+		WHERE m.collection_uuid = ?
+		AND f.done
+		ORDER BY f.name
+	`, collectionuuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []zipEntry
+	for rows.Next() {
+		var e zipEntry
+		if err := rows.Scan(&e.UUID, &e.Name, &e.Password); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// shown returns the files of a collection which its visitors can download.
+// Files keep their own password, so those which have one are only shown to
+// the users who may manage them.
+func shown(ctx *gin.Context, db *sql.DB, collectionuuid string) ([]zipEntry, error) {
+	entries, err := members(db, collectionuuid)
+	if err != nil {
+		return nil, err
+	}
+
+	return accessible(db, entries, sessions.Default(ctx).Get("user_id"))
+}
+
+// memberID identifies a file within a collection without revealing its UUID,
+// which would otherwise end up in the links of the album.
+func memberID(collectionuuid string, fileuuid string) string {
+	sum := sha256.Sum256([]byte(collectionuuid + "/" + fileuuid))
+	return hex.EncodeToString(sum[:8])
+}
+
+// granted reports whether the visitor may see the files of a collection.
+func granted(session sessions.Session, col collection) bool {
+	if !col.Password.Valid || session.Get("user_id") == col.Owner {
+		return true
+	}
+
+	unlocked, _ := session.Get("collections").([]string)
+	for _, u := range unlocked {
+		if u == col.UUID {
+			return true
+		}
+	}
+	return false
+}
+
+func registerCollections(router *gin.Engine, priv *gin.RouterGroup, db *sql.DB, c config, offer func(string, string, string, *gin.Context), t *throttle) {
+	owners := priv.Group("/collections", allow(roleAdmin, roleUser))
+
+	owners.GET("/", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		rows, err := db.Query(`
+			SELECT c.uuid, c.name, c.expiry, c.password IS NOT NULL, COUNT(m.file_uuid)
+			FROM collection c
+			LEFT JOIN collection_file m
+			ON m.collection_uuid = c.uuid
+			WHERE c.owner_id = ?
+			GROUP BY c.uuid
+			ORDER BY c.created DESC
+		`, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		defer func() {
+			err := rows.Close()
+			if err != nil {
+				log.Printf("Unable to close rows: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+		}()
+
+		var collections []gin.H
+		for rows.Next() {
+			var (
+				collectionuuid string
+				name           string
+				expiry         int64
+				protected      bool
+				files          int
+			)
+			if err := rows.Scan(&collectionuuid, &name, &expiry, &protected, &files); err != nil {
+				log.Printf("Could not copy values from database: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+			collections = append(collections, gin.H{
+				"UUID":      collectionuuid,
+				"Name":      name,
+				"Expiry":    time.Unix(expiry, 0),
+				"Protected": protected,
+				"Files":     files,
+			})
+		}
+		if err = rows.Err(); err != nil {
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		page(ctx, "collections", gin.H{
+			"Collections": collections,
+		})
+	})
+
+	owners.POST("/", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			Name     string `form:"name" binding:"required"`
+			Password string `form:"password"`
+			Time     int64  `form:"time" binding:"required"`
+			Unit     string `form:"unit" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/collections/")
+			return
+		}
+
+		now := time.Now()
+
+		add, err := asUnit(in.Unit, time.Duration(in.Time))
+		if err != nil || in.Time < 1 || add > time.Duration(24*365)*time.Hour {
+			ctx.Redirect(http.StatusFound, "/collections/")
+			return
+		}
+
+		password, err := hashPassword(in.Password)
+		if err != nil {
+			log.Printf("Unable to hash provided password: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/collections/")
+			return
+		}
+
+		collectionuuid, err := createCollection(db, in.Name, session.Get("user_id"), now.Add(add), password)
+		if err != nil {
+			log.Printf("Unable to insert collection: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/collections/")
+			return
+		}
+
+		ctx.Redirect(http.StatusFound, "/collections/"+collectionuuid)
+	})
+
+	// own looks up the collection of the route, which has to belong to the
+	// current user.
+	own := func(ctx *gin.Context) (collection, bool) {
+		col, err := lookupCollection(db, ctx.Param("uuid"))
+		if err != nil || sessions.Default(ctx).Get("user_id") != col.Owner {
+			ctx.Redirect(http.StatusFound, "/collections/")
+			return collection{}, false
+		}
+		return col, true
+	}
+
+	owners.GET("/:uuid", func(ctx *gin.Context) {
+		col, ok := own(ctx)
+		if !ok {
+			return
+		}
+
+		entries, err := members(db, col.UUID)
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT uuid, name
+			FROM file
+			WHERE owner_id = ?
+			AND done
+			AND uuid NOT IN (
+				SELECT file_uuid
+				FROM collection_file
+				WHERE collection_uuid = ?
+			)
+			ORDER BY name
+		`, col.Owner, col.UUID)
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		defer func() {
+			err := rows.Close()
+			if err != nil {
+				log.Printf("Unable to close rows: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+		}()
+
+		var candidates []zipEntry
+		for rows.Next() {
+			var e zipEntry
+			if err := rows.Scan(&e.UUID, &e.Name); err != nil {
+				log.Printf("Could not copy values from database: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+			candidates = append(candidates, e)
+		}
+		if err = rows.Err(); err != nil {
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		page(ctx, "collection", gin.H{
+			"Collection": col,
+			"Link":       link(ctx, c, "/albums/"+col.UUID),
+			"Members":    entries,
+			"Candidates": candidates,
+		})
+	})
+
+	owners.POST("/:uuid/add", func(ctx *gin.Context) {
+		col, ok := own(ctx)
+		if !ok {
+			return
+		}
+
+		for _, fileuuid := range ctx.PostFormArray("file") {
+			_, err := db.Exec(`
+				INSERT OR IGNORE INTO collection_file (collection_uuid, file_uuid)
+				SELECT ?, uuid
+				FROM file
+				WHERE uuid = ?
+				AND owner_id = ?
+				AND done
+			`, col.UUID, fileuuid, col.Owner)
+			if err != nil {
+				log.Printf("Unable to add file to collection: %s", err.Error())
+			}
+		}
+
+		ctx.Redirect(http.StatusFound, "/collections/"+col.UUID)
+	})
+
+	owners.POST("/:uuid/remove", func(ctx *gin.Context) {
+		col, ok := own(ctx)
+		if !ok {
+			return
+		}
+
+		_, err := db.Exec(`
+			DELETE FROM collection_file
+			WHERE collection_uuid = ?
+			AND file_uuid = ?
+		`, col.UUID, ctx.PostForm("file"))
+		if err != nil {
+			log.Printf("Unable to remove file from collection: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/collections/"+col.UUID)
+	})
+
+	owners.POST("/:uuid/delete", func(ctx *gin.Context) {
+		col, ok := own(ctx)
+		if !ok {
+			return
+		}
+
+		if !confirm(ctx, "Delete the collection "+col.Name+"? Its files are kept.") {
+			return
+		}
+
+		removeCollection(col.UUID, db)
+
+		ctx.Redirect(http.StatusFound, "/collections/")
+	})
+
+	// Everything below is reachable through the share link.
+
+	router.GET("/albums/:uuid", func(ctx *gin.Context) {
+		col, err := lookupCollection(db, ctx.Param("uuid"))
+		if err != nil {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		if !granted(sessions.Default(ctx), col) {
+			ctx.HTML(http.StatusOK, "album", gin.H{
+				"Collection": col,
+			})
+			return
+		}
+
+		entries, err := shown(ctx, db, col.UUID)
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		var files []gin.H
+		for _, e := range entries {
+			files = append(files, gin.H{
+				"ID":   memberID(col.UUID, e.UUID),
+				"Name": e.Name,
+			})
+		}
+
+		ctx.HTML(http.StatusOK, "album", gin.H{
+			"Collection": col,
+			"Unlocked":   true,
+			"Members":    files,
+		})
+	})
+
+	router.POST("/albums/:uuid", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		col, err := lookupCollection(db, ctx.Param("uuid"))
+		if err != nil || !col.Password.Valid {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(col.Password.String), []byte(ctx.PostForm("password"))) != nil {
+			ctx.Redirect(http.StatusFound, "/albums/"+col.UUID)
+			return
+		}
+
+		unlocked, _ := session.Get("collections").([]string)
+		session.Set("collections", append(unlocked, col.UUID))
+		err = session.Save()
+		if err != nil {
+			log.Printf("Could not save data to session: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		ctx.Redirect(http.StatusFound, "/albums/"+col.UUID)
+	})
+
+	// visible looks up the collection of the route and checks that the visitor
+	// has unlocked it.
+	visible := func(ctx *gin.Context) (collection, bool) {
+		col, err := lookupCollection(db, ctx.Param("uuid"))
+		if err != nil || !granted(sessions.Default(ctx), col) {
+			ctx.Redirect(http.StatusFound, "/albums/"+ctx.Param("uuid"))
+			return collection{}, false
+		}
+		return col, true
+	}
+
+	router.GET("/albums/:uuid/files/:file", func(ctx *gin.Context) {
+		col, ok := visible(ctx)
+		if !ok {
+			return
+		}
+
+		entries, err := shown(ctx, db, col.UUID)
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		for _, e := range entries {
+			if memberID(col.UUID, e.UUID) == ctx.Param("file") {
+				offer("", e.UUID, e.Name, ctx)
+				return
+			}
+		}
+
+		ctx.Redirect(http.StatusFound, "/albums/"+col.UUID)
+	})
+
+	router.GET("/albums/:uuid/zip", func(ctx *gin.Context) {
+		col, ok := visible(ctx)
+		if !ok {
+			return
+		}
+
+		entries, err := shown(ctx, db, col.UUID)
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		done, ok := t.begin(ctx, "")
+		if !ok {
+			return
+		}
+		defer done()
+
+		if !sendZip(ctx, db, c.Data, col.Name, entries) {
+			ctx.Redirect(http.StatusFound, "/albums/"+col.UUID)
+		}
+	})
+}
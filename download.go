@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// storeHash records the SHA-256 hash of the contents of a file.
+func storeHash(db *sql.DB, data string, fileuuid string) (string, error) {
+	hash, err := hashFile(filepath.Join(data, fileuuid))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`
+		UPDATE file
+		SET hash = ?
+		WHERE uuid = ?
+	`, hash, fileuuid)
+	if err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// notModified reports whether a conditional request would be answered with
+// 304 Not Modified, in which case nothing is downloaded.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// cacheControl tells caches for how long a file may be kept. Files behind a
+// password must not end up in shared caches and files with a download limit
+// must not be kept at all, since every download has to be counted.
+func cacheControl(expiry time.Time, password bool, limited bool) string {
+	if limited {
+		return "no-store"
+	}
+
+	maxAge := int64(time.Until(expiry).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	scope := "public"
+	if password {
+		scope = "private"
+	}
+
+	return fmt.Sprintf("%s, max-age=%d", scope, maxAge)
+}
+
+// sendFile answers a download of a file through a link, or directly if the link
+// is empty, including HEAD, conditional and range requests. Only requests which
+// actually send the contents count as downloads.
+func sendFile(ctx *gin.Context, db *sql.DB, c config, link string, fileuuid string, filename string, disposition string, mimeType string) {
+	row := db.QueryRow(`
+		SELECT password IS NOT NULL, expiry, max_downloads IS NOT NULL, hash
+		FROM file
+		WHERE uuid = ?
+	`, fileuuid)
+
+	var (
+		password bool
+		expiry   int64
+		limited  bool
+		hash     sql.NullString
+	)
+	if err := row.Scan(&password, &expiry, &limited, &hash); err != nil {
+		log.Printf("Unable to query file: %s", err.Error())
+		ctx.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	if link != "" {
+		l, err := lookupLink(db, link)
+		if err != nil {
+			log.Printf("Unable to query link: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+		password = password || l.Password.Valid
+		limited = limited || l.MaxDownloads.Valid
+		if l.Expiry.Valid && l.Expiry.Int64 < expiry {
+			expiry = l.Expiry.Int64
+		}
+	}
+
+	// Files uploaded before hashes were stored are hashed on their first
+	// download.
+	if !hash.Valid {
+		h, err := storeHash(db, c.Data, fileuuid)
+		if err != nil {
+			log.Printf("Unable to hash file: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		hash = sql.NullString{String: h, Valid: true}
+	}
+
+	file, err := os.Open(filepath.Join(c.Data, fileuuid))
+	if err != nil {
+		log.Printf("Unable to open file: %s", err.Error())
+		ctx.AbortWithStatus(500)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Printf("Unable to open file: %s", err.Error())
+		ctx.AbortWithStatus(500)
+		return
+	}
+
+	etag := `"` + hash.String + `"`
+
+	// Every request for a file with a download limit is a whole download, so
+	// that the limit cannot be avoided by fetching the file in pieces.
+	if limited {
+		ctx.Request.Header.Del("Range")
+		ctx.Request.Header.Del("If-Range")
+	}
+
+	if ctx.Request.Method == http.MethodGet && !notModified(ctx.Request, etag, info.ModTime()) {
+		allowed, last, err := countDownload(db, fileuuid, link)
+		if err != nil {
+			log.Printf("Unable to count download: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		if !allowed {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		// The file is gone once it has been downloaded as often as allowed.
+		if last {
+			defer remove(fileuuid, c.Data, db)
+		}
+	}
+
+	ctx.Header("ETag", etag)
+	ctx.Header("Cache-Control", cacheControl(time.Unix(expiry, 0), password, limited))
+	ctx.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{
+		"filename": filename,
+	}))
+	if mimeType != "" {
+		ctx.Header("Content-Type", mimeType)
+	}
+
+	http.ServeContent(ctx.Writer, ctx.Request, filename, info.ModTime(), file)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSendFile(t *testing.T) {
+	db := testDB(t)
+
+	var c config
+	c.Data = t.TempDir()
+
+	owner, err := createUser(db, "alice", "password", roleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileuuid := testFile(t, db, c.Data, owner, "report.txt", "0123456789")
+
+	router := gin.New()
+	send := func(ctx *gin.Context) {
+		sendFile(ctx, db, c, "", fileuuid, "report.txt", "attachment", "")
+	}
+	router.GET("/", send)
+	router.HEAD("/", send)
+
+	request := func(t *testing.T, method string, header http.Header) (*http.Response, string) {
+		t.Helper()
+
+		r := httptest.NewRequest(method, "/", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		res := w.Result()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res, string(body)
+	}
+
+	downloads := func(t *testing.T) int64 {
+		t.Helper()
+
+		var n int64
+		if err := db.QueryRow(`SELECT downloads FROM file WHERE uuid = ?`, fileuuid).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// The first download hashes the file, which the other requests depend on.
+	res, body := request(t, http.MethodGet, nil)
+	if res.StatusCode != http.StatusOK || body != "0123456789" {
+		t.Fatalf("got %d %q", res.StatusCode, body)
+	}
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	modified := res.Header.Get("Last-Modified")
+
+	tests := []struct {
+		name    string
+		method  string
+		header  http.Header
+		status  int
+		body    string
+		counted bool
+	}{
+		{"head", http.MethodHead, nil, http.StatusOK, "", false},
+		{"matching etag", http.MethodGet, http.Header{"If-None-Match": {etag}}, http.StatusNotModified, "", false},
+		{"weak etag", http.MethodGet, http.Header{"If-None-Match": {`"other", W/` + etag}}, http.StatusNotModified, "", false},
+		{"other etag", http.MethodGet, http.Header{"If-None-Match": {`"other"`}}, http.StatusOK, "0123456789", true},
+		{"unmodified", http.MethodGet, http.Header{"If-Modified-Since": {modified}}, http.StatusNotModified, "", false},
+		{"conditional head", http.MethodHead, http.Header{"If-None-Match": {etag}}, http.StatusNotModified, "", false},
+		{"range", http.MethodGet, http.Header{"Range": {"bytes=2-5"}}, http.StatusPartialContent, "2345", true},
+		{"matching if-range", http.MethodGet, http.Header{"Range": {"bytes=8-"}, "If-Range": {etag}}, http.StatusPartialContent, "89", true},
+		{"stale if-range", http.MethodGet, http.Header{"Range": {"bytes=8-"}, "If-Range": {`"other"`}}, http.StatusOK, "0123456789", true},
+		{"head with range", http.MethodHead, http.Header{"Range": {"bytes=2-5"}}, http.StatusPartialContent, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := downloads(t)
+
+			res, body := request(t, tt.method, tt.header)
+			if res.StatusCode != tt.status || body != tt.body {
+				t.Fatalf("got %d %q, want %d %q", res.StatusCode, body, tt.status, tt.body)
+			}
+
+			if counted := downloads(t) > before; counted != tt.counted {
+				t.Fatalf("counted %t, want %t", counted, tt.counted)
+			}
+		})
+	}
+}
+
+func TestSendFileLimited(t *testing.T) {
+	db := testDB(t)
+
+	var c config
+	c.Data = t.TempDir()
+
+	owner, err := createUser(db, "alice", "password", roleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileuuid := testFile(t, db, c.Data, owner, "report.txt", "0123456789")
+
+	_, err = db.Exec(`
+		UPDATE file
+		SET max_downloads = 2
+		WHERE uuid = ?
+	`, fileuuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	send := func(ctx *gin.Context) {
+		sendFile(ctx, db, c, "", fileuuid, "report.txt", "attachment", "")
+	}
+	router.GET("/", send)
+	router.HEAD("/", send)
+
+	request := func(method string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// Looking at a file does not use up its downloads.
+	for i := 0; i < 3; i++ {
+		if w := request(http.MethodHead, nil); w.Code != http.StatusOK {
+			t.Fatalf("HEAD got %d", w.Code)
+		}
+	}
+
+	// Ranges are ignored, so that the limit cannot be avoided by fetching the
+	// file in pieces.
+	w := request(http.MethodGet, http.Header{"Range": {"bytes=0-0"}})
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Fatalf("got Cache-Control %q", cc)
+	}
+
+	w = request(http.MethodGet, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+
+	// The file is gone after the last download.
+	err = db.QueryRow(`SELECT uuid FROM file WHERE uuid = ?`, fileuuid).Scan(new(string))
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("file still exists after its last download: %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+var errInvitation = errors.New("invitation is invalid, expired or has already been used")
+
+// createInvitation returns the token for a new invitation. Only its hash is
+// stored, so the token cannot be shown again later.
+func createInvitation(db *sql.DB, creator sql.NullInt64, role string, quota sql.NullInt64, expiry time.Time) (string, error) {
+	if !validRole(role) {
+		return "", fmt.Errorf("invalid role %s", role)
+	}
+
+	token := randomString(32)
+
+	_, err := db.Exec(`
+		INSERT INTO invitation (token, creator_id, role, quota, created, expiry)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, hashToken(token), creator, role, quota, time.Now().Unix(), expiry.Unix())
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// redeemInvitation creates the invited user and records the use of the
+// invitation, so that it cannot be used again.
+func redeemInvitation(db *sql.DB, token string, name string, password string, address string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`
+		SELECT id, role, quota
+		FROM invitation
+		WHERE token = ?
+		AND used IS NULL
+		AND expiry > ?
+	`, hashToken(token), time.Now().Unix())
+
+	var (
+		id    int
+		role  string
+		quota sql.NullInt64
+	)
+	if err := row.Scan(&id, &role, &quota); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, errInvitation
+		}
+		return 0, err
+	}
+
+	userid, err := createUser(tx, name, password, role)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := setQuota(tx, userid, quota); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`
+		UPDATE invitation
+		SET
+			used = ?,
+			user_id = ?,
+			address = ?
+		WHERE id = ?
+		AND used IS NULL
+	`, time.Now().Unix(), userid, address, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return 0, errInvitation
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Invitation %d was used by %s", id, name)
+
+	return userid, nil
+}
+
+func validInvitation(db *sql.DB, token string) bool {
+	row := db.QueryRow(`
+		SELECT COUNT(*)
+		FROM invitation
+		WHERE token = ?
+		AND used IS NULL
+		AND expiry > ?
+	`, hashToken(token), time.Now().Unix())
+
+	var n int
+	return row.Scan(&n) == nil && n == 1
+}
+
+func registerInvitations(router *gin.Engine, priv *gin.RouterGroup, db *sql.DB, c config) {
+	router.GET("/invite/:token", func(ctx *gin.Context) {
+		ctx.HTML(http.StatusOK, "invite", gin.H{
+			"Token": ctx.Param("token"),
+			"Valid": validInvitation(db, ctx.Param("token")),
+		})
+	})
+
+	router.POST("/invite/:token", func(ctx *gin.Context) {
+		token := ctx.Param("token")
+
+		var in struct {
+			Name         string `form:"name" binding:"required"`
+			Password     string `form:"password" binding:"required"`
+			Confirmation string `form:"confirmation" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil || in.Password != in.Confirmation {
+			ctx.Redirect(http.StatusFound, "/invite/"+token)
+			return
+		}
+
+		userid, err := redeemInvitation(db, token, in.Name, in.Password, ctx.ClientIP())
+		if err != nil {
+			log.Printf("Unable to redeem invitation: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/invite/"+token)
+			return
+		}
+
+		session := sessions.Default(ctx)
+		session.Set("user_id", userid)
+		err = session.Save()
+		if err != nil {
+			log.Printf("Could not save data to session: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		ctx.Redirect(http.StatusFound, "/files/")
+	})
+
+	admin := priv.Group("/admin/invitations", allow(roleAdmin))
+
+	list := func(ctx *gin.Context, h gin.H) {
+		rows, err := db.Query(`
+			SELECT i.id, c.name, i.role, i.quota, i.created, i.expiry, i.used, u.name, i.address
+			FROM invitation i
+			LEFT JOIN user c
+			ON i.creator_id = c.id
+			LEFT JOIN user u
+			ON i.user_id = u.id
+			ORDER BY i.created DESC
+		`)
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		defer func() {
+			err := rows.Close()
+			if err != nil {
+				log.Printf("Unable to close rows: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+		}()
+
+		var invitations []gin.H
+		for rows.Next() {
+			var (
+				id      int
+				creator sql.NullString
+				role    string
+				quota   sql.NullInt64
+				created int64
+				expiry  int64
+				used    sql.NullInt64
+				user    sql.NullString
+				address sql.NullString
+			)
+			if err := rows.Scan(&id, &creator, &role, &quota, &created, &expiry, &used, &user, &address); err != nil {
+				log.Printf("Could not copy values from database: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+
+			invitation := gin.H{
+				"ID":      id,
+				"Creator": creator.String,
+				"Role":    role,
+				"Created": time.Unix(created, 0),
+				"Expiry":  time.Unix(expiry, 0),
+				"Expired": time.Now().Unix() >= expiry,
+				"Used":    used.Valid,
+				"User":    user.String,
+				"Address": address.String,
+			}
+			if quota.Valid {
+				invitation["Quota"] = formatSize(quota.Int64)
+			}
+			if used.Valid {
+				invitation["UsedAt"] = time.Unix(used.Int64, 0)
+			}
+			invitations = append(invitations, invitation)
+		}
+		if err = rows.Err(); err != nil {
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		h["Invitations"] = invitations
+		h["Roles"] = roles
+		page(ctx, "invitations", h)
+	}
+
+	admin.GET("/", func(ctx *gin.Context) {
+		list(ctx, gin.H{})
+	})
+
+	admin.POST("/create", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			Role  string `form:"role" binding:"required"`
+			Quota string `form:"quota"`
+			Time  int64  `form:"time" binding:"required"`
+			Unit  string `form:"unit" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/admin/invitations/")
+			return
+		}
+
+		add, err := asUnit(in.Unit, time.Duration(in.Time))
+		if err != nil || in.Time < 1 {
+			ctx.Redirect(http.StatusFound, "/admin/invitations/")
+			return
+		}
+
+		var quota sql.NullInt64
+		if in.Quota != "" {
+			n, err := parseSize(in.Quota)
+			if err != nil {
+				ctx.Redirect(http.StatusFound, "/admin/invitations/")
+				return
+			}
+			quota = sql.NullInt64{
+				Int64: n,
+				Valid: true,
+			}
+		}
+
+		creator := sql.NullInt64{
+			Int64: int64(session.Get("user_id").(int)),
+			Valid: true,
+		}
+
+		token, err := createInvitation(db, creator, in.Role, quota, time.Now().Add(add))
+		if err != nil {
+			log.Printf("Unable to create invitation: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/admin/invitations/")
+			return
+		}
+
+		// The link is only shown once, right after it has been created.
+		list(ctx, gin.H{
+			"Link": link(ctx, c, "/invite/"+token),
+		})
+	})
+
+	admin.POST("/revoke", func(ctx *gin.Context) {
+		id, err := strconv.Atoi(ctx.PostForm("id"))
+		if err != nil {
+			ctx.Redirect(http.StatusFound, "/admin/invitations/")
+			return
+		}
+
+		if !confirm(ctx, "Revoke this invitation?") {
+			return
+		}
+
+		_, err = db.Exec(`
+			DELETE FROM invitation
+			WHERE id = ?
+			AND used IS NULL
+		`, id)
+		if err != nil {
+			log.Printf("Unable to delete invitation: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/admin/invitations/")
+	})
+}
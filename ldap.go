@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+type ldapConfig struct {
+	URL                string            `toml:"url"`
+	StartTLS           bool              `toml:"start_tls"`
+	InsecureSkipVerify bool              `toml:"insecure_skip_verify"`
+	BindDN             string            `toml:"bind_dn"`
+	BindPasswordFile   string            `toml:"bind_password_file"`
+	BaseDN             string            `toml:"base_dn"`
+	Filter             string            `toml:"filter"`
+	NameAttribute      string            `toml:"name_attribute"`
+	GroupBaseDN        string            `toml:"group_base_dn"`
+	GroupFilter        string            `toml:"group_filter"`
+	GroupAttribute     string            `toml:"group_attribute"`
+	Roles              map[string]string `toml:"roles"`
+}
+
+type ldapUser struct {
+	DN     string
+	Name   string
+	Groups []string
+}
+
+var errLDAPCredentials = errors.New("invalid credentials")
+
+// ldapAuthenticate looks up the user with the service account and then binds as
+// the user to verify the password.
+func ldapAuthenticate(lc ldapConfig, username string, password string) (*ldapUser, error) {
+	// An empty password would result in an unauthenticated bind, which succeeds.
+	if username == "" || password == "" {
+		return nil, errLDAPCredentials
+	}
+
+	u, err := url.Parse(lc.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: lc.InsecureSkipVerify,
+	}
+
+	conn, err := ldap.DialURL(lc.URL, ldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetTimeout(10 * time.Second)
+
+	if lc.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			return nil, fmt.Errorf("unable to start TLS: %w", err)
+		}
+	}
+
+	bind := func() error {
+		if lc.BindDN == "" {
+			return nil
+		}
+
+		bindPassword, err := os.ReadFile(lc.BindPasswordFile)
+		if err != nil {
+			return err
+		}
+
+		return conn.Bind(lc.BindDN, strings.TrimSpace(string(bindPassword)))
+	}
+
+	if err := bind(); err != nil {
+		return nil, fmt.Errorf("unable to bind service account: %w", err)
+	}
+
+	filter := lc.Filter
+	if filter == "" {
+		filter = "(uid=%s)"
+	}
+
+	nameAttribute := lc.NameAttribute
+	if nameAttribute == "" {
+		nameAttribute = "uid"
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		lc.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(username)),
+		[]string{"dn", nameAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for user: %w", err)
+	}
+
+	if len(res.Entries) != 1 {
+		return nil, errLDAPCredentials
+	}
+
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errLDAPCredentials
+		}
+		return nil, fmt.Errorf("unable to bind user: %w", err)
+	}
+
+	user := &ldapUser{
+		DN:   entry.DN,
+		Name: entry.GetAttributeValue(nameAttribute),
+	}
+	if user.Name == "" {
+		user.Name = username
+	}
+
+	if lc.GroupFilter == "" {
+		return user, nil
+	}
+
+	// Groups are looked up with the service account again, since users are not
+	// necessarily allowed to read them.
+	if err := bind(); err != nil {
+		return nil, fmt.Errorf("unable to bind service account: %w", err)
+	}
+
+	groupBaseDN := lc.GroupBaseDN
+	if groupBaseDN == "" {
+		groupBaseDN = lc.BaseDN
+	}
+
+	groupAttribute := lc.GroupAttribute
+	if groupAttribute == "" {
+		groupAttribute = "cn"
+	}
+
+	res, err = conn.Search(ldap.NewSearchRequest(
+		groupBaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 10, false,
+		fmt.Sprintf(lc.GroupFilter, ldap.EscapeFilter(entry.DN)),
+		[]string{groupAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for groups: %w", err)
+	}
+
+	// Users have to be in at least one group matched by the filter.
+	if len(res.Entries) == 0 {
+		return nil, errLDAPCredentials
+	}
+
+	for _, group := range res.Entries {
+		user.Groups = append(user.Groups, group.GetAttributeValue(groupAttribute))
+	}
+
+	return user, nil
+}
+
+func ldapLogin(db *sql.DB, lc ldapConfig, username string, password string) (int, error) {
+	user, err := ldapAuthenticate(lc, username, password)
+	if err != nil {
+		return 0, err
+	}
+
+	userid, err := provision(db, "ldap", user.DN, user.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(lc.Roles) > 0 {
+		role := mapRole(user.Groups, lc.Roles)
+		if role == "" {
+			role = roleUser
+		}
+		if err := assignRole(db, userid, role); err != nil {
+			return 0, err
+		}
+	}
+
+	return userid, nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testEntry is an entry of the directory served by testDirectory.
+type testEntry struct {
+	dn         string
+	password   string
+	attributes map[string]string
+}
+
+// testDirectory is an in-process LDAP server which understands just enough of
+// the protocol for binds and searches with a single equality filter.
+type testDirectory struct {
+	net.Listener
+
+	entries []testEntry
+	mu      sync.Mutex
+	binds   []string
+}
+
+func newTestDirectory(t *testing.T, entries ...testEntry) *testDirectory {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	d := &testDirectory{
+		Listener: l,
+		entries:  entries,
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+
+	return d
+}
+
+func (d *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+
+			d.mu.Lock()
+			d.binds = append(d.binds, dn)
+			d.mu.Unlock()
+
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			for _, e := range d.entries {
+				if e.dn == dn && e.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationBindResponse, code)))
+		case ldap.ApplicationSearchRequest:
+			base := op.Children[0].Value.(string)
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+
+			// Filters look like (uid=alice) or (member=uid=alice,ou=people).
+			attribute, value, _ := strings.Cut(strings.Trim(filter, "()"), "=")
+			for _, e := range d.entries {
+				if !strings.HasSuffix(e.dn, base) || e.attributes[attribute] != value {
+					continue
+				}
+
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+				attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for name, v := range e.attributes {
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+					attribute.AppendChild(values)
+					attributes.AppendChild(attribute)
+				}
+				entry.AppendChild(attributes)
+				conn.Write(ldapMessage(id, entry))
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		default:
+			return
+		}
+	}
+}
+
+// bound returns the DNs which have been bound since the last call.
+func (d *testDirectory) bound() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	binds := d.binds
+	d.binds = nil
+	return binds
+}
+
+func ldapMessage(id int64, op *ber.Packet) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	packet.AppendChild(op)
+	return packet.Bytes()
+}
+
+func ldapResult(tag ber.Tag, code int64) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return result
+}
+
+const (
+	testServiceDN = "cn=hiraeth,dc=example,dc=org"
+	testPeopleDN  = "ou=people,dc=example,dc=org"
+)
+
+// testLDAP starts a directory with a service account, the given people and a
+// group of administrators containing the first one.
+func testLDAP(t *testing.T, people ...string) (*testDirectory, config) {
+	t.Helper()
+
+	entries := []testEntry{{
+		dn:       testServiceDN,
+		password: "service",
+	}}
+	for _, name := range people {
+		entries = append(entries, testEntry{
+			dn:       "uid=" + name + "," + testPeopleDN,
+			password: name + "-password",
+			attributes: map[string]string{
+				"uid": name,
+			},
+		})
+	}
+	if len(people) > 0 {
+		entries = append(entries, testEntry{
+			dn: "cn=admins,ou=groups,dc=example,dc=org",
+			attributes: map[string]string{
+				"cn":     "admins",
+				"member": "uid=" + people[0] + "," + testPeopleDN,
+			},
+		})
+	}
+
+	d := newTestDirectory(t, entries...)
+
+	return d, testLDAPConfig(t, d)
+}
+
+// testLDAPConfig configures the service account of a directory.
+func testLDAPConfig(t *testing.T, d *testDirectory) config {
+	t.Helper()
+
+	passwordFile := filepath.Join(t.TempDir(), "bind_password")
+	if err := os.WriteFile(passwordFile, []byte("service\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var c config
+	c.LDAP = ldapConfig{
+		URL:              "ldap://" + d.Addr().String(),
+		BindDN:           testServiceDN,
+		BindPasswordFile: passwordFile,
+		BaseDN:           "dc=example,dc=org",
+	}
+
+	return c
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	d, c := testLDAP(t, "dave")
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		err      error
+		binds    []string
+	}{
+		{"valid", "dave", "dave-password", nil, []string{testServiceDN, "uid=dave," + testPeopleDN}},
+		{"wrong password", "dave", "wrong", errLDAPCredentials, []string{testServiceDN, "uid=dave," + testPeopleDN}},
+		{"unknown user", "erin", "erin-password", errLDAPCredentials, []string{testServiceDN}},
+		{"empty password", "dave", "", errLDAPCredentials, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := ldapAuthenticate(c.LDAP, tt.username, tt.password)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err == nil && (user.DN != "uid=dave,"+testPeopleDN || user.Name != "dave") {
+				t.Fatalf("authenticated as %s (%s)", user.DN, user.Name)
+			}
+
+			// The user is looked up with the service account before their
+			// own password is checked.
+			if binds := d.bound(); strings.Join(binds, ";") != strings.Join(tt.binds, ";") {
+				t.Fatalf("bound %v, want %v", binds, tt.binds)
+			}
+		})
+	}
+}
+
+func TestLDAPGroups(t *testing.T) {
+	_, c := testLDAP(t, "dave", "frank")
+	c.LDAP.GroupFilter = "(member=%s)"
+	c.LDAP.Roles = map[string]string{"admins": roleAdmin}
+
+	db := testDB(t)
+
+	userid, err := authenticate(db, c, "dave", "dave-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var role string
+	if err := db.QueryRow(`SELECT role FROM user WHERE id = ?`, userid).Scan(&role); err != nil {
+		t.Fatal(err)
+	}
+	if role != roleAdmin {
+		t.Fatalf("got role %s, want %s", role, roleAdmin)
+	}
+
+	// Users outside of all groups matched by the filter cannot log in.
+	if _, err := authenticate(db, c, "frank", "frank-password"); !errors.Is(err, errLDAPCredentials) {
+		t.Fatalf("got error %v, want %v", err, errLDAPCredentials)
+	}
+}
+
+func TestLDAPFallback(t *testing.T) {
+	d, c := testLDAP(t, "dave", "grace")
+	db := testDB(t)
+
+	local, err := createUser(db, "grace", "local-password", roleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Local users are authenticated locally, without asking the directory.
+	userid, err := authenticate(db, c, "grace", "local-password")
+	if err != nil || userid != local {
+		t.Fatalf("got user %d and error %v, want user %d", userid, err, local)
+	}
+	if binds := d.bound(); len(binds) != 0 {
+		t.Fatalf("bound %v for a local user", binds)
+	}
+
+	// A user of the same name in the directory cannot take over the local
+	// account.
+	if _, err := authenticate(db, c, "grace", "grace-password"); err == nil {
+		t.Fatal("logged in as the local user with the password from the directory")
+	}
+	if binds := d.bound(); len(binds) != 0 {
+		t.Fatalf("bound %v for a local user", binds)
+	}
+
+	// Unknown users are provisioned from the directory on their first login,
+	// and authenticated against it afterwards.
+	userid, err = authenticate(db, c, "dave", "dave-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binds := d.bound(); len(binds) == 0 {
+		t.Fatal("directory was not asked for an unknown user")
+	}
+
+	again, err := authenticate(db, c, "dave", "dave-password")
+	if err != nil || again != userid {
+		t.Fatalf("got user %d and error %v, want user %d", again, err, userid)
+	}
+	if _, err := authenticate(db, c, "dave", "wrong"); err == nil {
+		t.Fatal("logged in with a wrong password")
+	}
+
+	var provider, subject string
+	if err := db.QueryRow(`SELECT provider, subject FROM user WHERE id = ?`, userid).Scan(&provider, &subject); err != nil {
+		t.Fatal(err)
+	}
+	if provider != "ldap" || subject != "uid=dave,"+testPeopleDN {
+		t.Fatalf("provisioned with %s %s", provider, subject)
+	}
+
+	// Without a directory, only local users can log in.
+	c.LDAP.URL = ""
+	if _, err := authenticate(db, c, "dave", "dave-password"); err == nil {
+		t.Fatal("logged in as a user of the directory without one configured")
+	}
+}
+
+func TestLDAPNameCollision(t *testing.T) {
+	d := newTestDirectory(t, testEntry{
+		dn:       testServiceDN,
+		password: "service",
+	}, testEntry{
+		dn:       "uid=hk," + testPeopleDN,
+		password: "hk-password",
+		attributes: map[string]string{
+			"uid": "hk",
+			"cn":  "heidi",
+		},
+	})
+	c := testLDAPConfig(t, d)
+	c.LDAP.NameAttribute = "cn"
+
+	db := testDB(t)
+
+	local, err := createUser(db, "heidi", "local-password", roleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The user of the directory would be provisioned under the name of the
+	// local user, which has to fail rather than link the two.
+	if _, err := authenticate(db, c, "hk", "hk-password"); err == nil {
+		t.Fatal("provisioned a user with the name of a local user")
+	}
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM user`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("%d users after the collision", n)
+	}
+
+	var provider sql.NullString
+	if err := db.QueryRow(`SELECT provider FROM user WHERE id = ?`, local).Scan(&provider); err != nil {
+		t.Fatal(err)
+	}
+	if provider.Valid {
+		t.Fatalf("local user has been linked to %s", provider.String)
+	}
+
+	// The local user can still log in with their own password.
+	if userid, err := authenticate(db, c, "heidi", "local-password"); err != nil || userid != local {
+		t.Fatalf("got user %d and error %v, want user %d", userid, err, local)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	// Short IDs are the only thing needed to download a file without a
+	// password, so they have to be hard to guess.
+	shortIDLength = 10
+)
+
+var (
+	errSlug     = errors.New("invalid slug")
+	errReserved = errors.New("reserved slug")
+	errTaken    = errors.New("slug already taken")
+)
+
+var slugPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{2,63}$`)
+
+// Slugs which could be mistaken for parts of hiraeth itself.
+var reservedSlugs = map[string]bool{
+	"admin":       true,
+	"albums":      true,
+	"api":         true,
+	"collections": true,
+	"downloads":   true,
+	"entries":     true,
+	"files":       true,
+	"login":       true,
+	"logout":      true,
+	"metrics":     true,
+	"paste":       true,
+	"put":         true,
+	"raw":         true,
+	"requests":    true,
+	"settings":    true,
+	"static":      true,
+	"upload":      true,
+}
+
+// A shareLink is a public way of downloading a file. Each link can have its own
+// password, expiry and download limit, which apply in addition to those of the
+// file. Its password replaces the one of the file.
+type shareLink struct {
+	Name         string
+	File         string
+	Vanity       bool
+	Password     sql.NullString
+	Expiry       sql.NullInt64
+	Downloads    int64
+	MaxDownloads sql.NullInt64
+}
+
+func randomShortID() string {
+	limit := big.NewInt(int64(len(base62)))
+
+	id := make([]byte, shortIDLength)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			log.Fatalf("Unable to read random bytes: %s", err.Error())
+		}
+		id[i] = base62[n.Int64()]
+	}
+
+	return string(id)
+}
+
+func checkSlug(name string) error {
+	if !slugPattern.MatchString(name) {
+		return errSlug
+	}
+	if reservedSlugs[strings.ToLower(name)] {
+		return errReserved
+	}
+	return nil
+}
+
+// createLink adds a link to a file. Links without a slug get a random short ID.
+func createLink(db execer, l shareLink) (string, error) {
+	if l.Vanity {
+		if err := checkSlug(l.Name); err != nil {
+			return "", err
+		}
+	}
+
+	// Try again in the unlikely case that the short ID is already in use.
+	for {
+		if !l.Vanity {
+			l.Name = randomShortID()
+		}
+
+		res, err := db.Exec(`
+			INSERT OR IGNORE INTO alias (name, file_uuid, vanity, created, password, expiry, max_downloads)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, l.Name, l.File, l.Vanity, time.Now().Unix(), l.Password, l.Expiry, l.MaxDownloads)
+		if err != nil {
+			return "", err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return "", err
+		}
+		if n == 1 {
+			return l.Name, nil
+		}
+		if l.Vanity {
+			return "", errTaken
+		}
+	}
+}
+
+// rotateLink gives a link a new short ID, so that it can no longer be used
+// under the old one.
+func rotateLink(db *sql.DB, fileuuid string, name string) (string, error) {
+	l, err := lookupLink(db, name)
+	if err != nil {
+		return "", err
+	}
+	if l.File != fileuuid || l.Vanity {
+		return "", sql.ErrNoRows
+	}
+
+	// Try again in the unlikely case that the short ID is already in use.
+	for {
+		id := randomShortID()
+
+		res, err := db.Exec(`
+			UPDATE OR IGNORE alias
+			SET name = ?
+			WHERE name = ?
+			AND file_uuid = ?
+			AND NOT vanity
+			AND created > 0
+		`, id, name, fileuuid)
+		if err != nil {
+			return "", err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil || n == 1 {
+			return id, err
+		}
+
+		// Nothing has been updated either because the short ID is taken or
+		// because the link has been revoked in the meantime.
+		var exists bool
+		err = db.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1
+				FROM alias
+				WHERE name = ?
+				AND file_uuid = ?
+				AND NOT vanity
+				AND created > 0
+			)
+		`, name, fileuuid).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", sql.ErrNoRows
+		}
+	}
+}
+
+func revokeLink(db *sql.DB, fileuuid string, name string) error {
+	_, err := db.Exec(`
+		DELETE FROM alias
+		WHERE name = ?
+		AND file_uuid = ?
+	`, name, fileuuid)
+	return err
+}
+
+// lookupLink finds a link which has not expired yet.
+func lookupLink(db *sql.DB, name string) (shareLink, error) {
+	row := db.QueryRow(`
+		SELECT name, file_uuid, vanity, password, expiry, downloads, max_downloads
+		FROM alias
+		WHERE name = ?
+		AND (expiry IS NULL OR expiry > ?)
+	`, name, time.Now().Unix())
+
+	var l shareLink
+	err := row.Scan(&l.Name, &l.File, &l.Vanity, &l.Password, &l.Expiry, &l.Downloads, &l.MaxDownloads)
+	return l, err
+}
+
+// linkFiles gives every file without a link a random one.
+func linkFiles(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+		SELECT uuid
+		FROM file
+		WHERE done
+		AND uuid NOT IN (
+			SELECT file_uuid
+			FROM alias
+			WHERE NOT vanity
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	var uuids []string
+	for rows.Next() {
+		var fileuuid string
+		if err := rows.Scan(&fileuuid); err != nil {
+			rows.Close()
+			return err
+		}
+		uuids = append(uuids, fileuuid)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, fileuuid := range uuids {
+		if _, err := createLink(tx, shareLink{File: fileuuid}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// firstLink returns the oldest link of a file, or an empty string if it has
+// none. Legacy links by UUID are never returned, so that the UUID is not handed
+// out again.
+func firstLink(db *sql.DB, fileuuid string) (string, error) {
+	row := db.QueryRow(`
+		SELECT name
+		FROM alias
+		WHERE file_uuid = ?
+		AND created > 0
+		AND (expiry IS NULL OR expiry > ?)
+		ORDER BY created
+		LIMIT 1
+	`, fileuuid, time.Now().Unix())
+
+	var name string
+	if err := row.Scan(&name); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	return name, nil
+}
+
+func links(ctx *gin.Context, db *sql.DB, c config, fileuuid string) ([]gin.H, error) {
+	rows, err := db.Query(`
+		SELECT name, vanity, created = 0, password IS NOT NULL, expiry, downloads, max_downloads
+		FROM alias
+		WHERE file_uuid = ?
+		ORDER BY created
+	`, fileuuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ls []gin.H
+	for rows.Next() {
+		var (
+			name         string
+			vanity       bool
+			legacy       bool
+			protected    bool
+			expiry       sql.NullInt64
+			downloads    int64
+			maxDownloads sql.NullInt64
+		)
+		if err := rows.Scan(&name, &vanity, &legacy, &protected, &expiry, &downloads, &maxDownloads); err != nil {
+			return nil, err
+		}
+
+		l := gin.H{
+			"Name":      name,
+			"Vanity":    vanity,
+			"Legacy":    legacy,
+			"Protected": protected,
+			"Downloads": downloads,
+		}
+		if !legacy {
+			l["URL"] = link(ctx, c, "/downloads/"+name)
+		}
+		if expiry.Valid {
+			l["Expiry"] = time.Unix(expiry.Int64, 0)
+			l["Expired"] = expiry.Int64 <= time.Now().Unix()
+		}
+		if maxDownloads.Valid {
+			l["MaxDownloads"] = maxDownloads.Int64
+		}
+		ls = append(ls, l)
+	}
+
+	return ls, rows.Err()
+}
+
+func registerLinks(priv *gin.RouterGroup, db *sql.DB) {
+	priv.POST("/files/:uuid/links", allow(roleAdmin, roleUser), func(ctx *gin.Context) {
+		fileuuid, ok := manageable(ctx, db)
+		if !ok {
+			return
+		}
+
+		var in struct {
+			Name      string `form:"name"`
+			Password  string `form:"password"`
+			Time      int64  `form:"time"`
+			Unit      string `form:"unit"`
+			Downloads int64  `form:"downloads"`
+		}
+		if err := ctx.ShouldBindWith(&in, binding.FormPost); err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+			return
+		}
+
+		password, err := hashPassword(in.Password)
+		if err != nil {
+			log.Printf("Unable to hash provided password: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		l := shareLink{
+			Name:     in.Name,
+			File:     fileuuid,
+			Vanity:   in.Name != "",
+			Password: password,
+		}
+
+		if in.Time > 0 {
+			add, err := asUnit(in.Unit, time.Duration(in.Time))
+			if err != nil {
+				log.Printf("Cannot convert duration to unit: %s", err.Error())
+				ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+				return
+			}
+			l.Expiry = sql.NullInt64{Int64: time.Now().Add(add).Unix(), Valid: true}
+		}
+
+		if in.Downloads > 0 {
+			l.MaxDownloads = sql.NullInt64{Int64: in.Downloads, Valid: true}
+		}
+
+		if _, err := createLink(db, l); err != nil {
+			log.Printf("Unable to create link %s: %s", in.Name, err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+	})
+
+	priv.POST("/files/:uuid/links/rotate", allow(roleAdmin, roleUser), func(ctx *gin.Context) {
+		fileuuid, ok := manageable(ctx, db)
+		if !ok {
+			return
+		}
+
+		if _, err := rotateLink(db, fileuuid, ctx.PostForm("name")); err != nil {
+			log.Printf("Unable to rotate link: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+	})
+
+	priv.POST("/files/:uuid/links/revoke", allow(roleAdmin, roleUser), func(ctx *gin.Context) {
+		fileuuid, ok := manageable(ctx, db)
+		if !ok {
+			return
+		}
+
+		if err := revokeLink(db, fileuuid, ctx.PostForm("name")); err != nil {
+			log.Printf("Unable to revoke link: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+	})
+}
@@ -2,16 +2,16 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/term"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -22,15 +22,25 @@ import (
 )
 
 type config struct {
-	Address           string   `toml:"address"`
-	Name              string   `toml:"name"`
-	Data              string   `toml:"data"`
-	DatabaseFile      string   `toml:"database_file"`
-	SessionSecretFile string   `toml:"session_secret_file"`
-	ChunkSize         int64    `toml:"chunk_size"`
-	Timeout           int      `toml:"timeout"`
-	TrustedProxies    []string `toml:"trusted_proxies"`
-	InlineTypes       []string `toml:"inline_types"`
+	Address           string       `toml:"address"`
+	URL               string       `toml:"url"`
+	Name              string       `toml:"name"`
+	Data              string       `toml:"data"`
+	DatabaseFile      string       `toml:"database_file"`
+	SessionSecretFile string       `toml:"session_secret_file"`
+	SessionIdle       int          `toml:"session_idle_timeout"`
+	SessionMaxAge     int          `toml:"session_max_age"`
+	ChunkSize         int64        `toml:"chunk_size"`
+	Timeout           int          `toml:"timeout"`
+	TrustedProxies    []string     `toml:"trusted_proxies"`
+	InlineTypes       []string     `toml:"inline_types"`
+	Previews          bool         `toml:"previews"`
+	StripMetadata     bool         `toml:"strip_metadata"`
+	RequireTOTP       bool         `toml:"require_totp"`
+	MetricsTokenFile  string       `toml:"metrics_token_file"`
+	Limits            limitsConfig `toml:"limits"`
+	OIDC              oidcConfig   `toml:"oidc"`
+	LDAP              ldapConfig   `toml:"ldap"`
 }
 
 func main() {
@@ -38,10 +48,12 @@ func main() {
 	log.SetPrefix("hiraeth: ")
 
 	c := config{
-		Address:      "localhost:8080",
-		DatabaseFile: "hiraeth.db",
-		ChunkSize:    1024 * 1024 * 32,
-		Timeout:      60,
+		Address:       "localhost:8080",
+		DatabaseFile:  "hiraeth.db",
+		ChunkSize:     1024 * 1024 * 32,
+		Timeout:       60,
+		SessionIdle:   60 * 60 * 24,
+		SessionMaxAge: 60 * 60 * 24 * 30,
 	}
 
 	paths := []string{
@@ -65,8 +77,17 @@ func main() {
 			{
 				Name:  "run",
 				Usage: "run hiraeth",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "require-totp",
+						Usage: "require two-factor authentication for all users",
+					},
+				},
 				Action: func(ctx *cli.Context) error {
 					readConfig(cf, paths, toml.Unmarshal, &c)
+					if ctx.Bool("require-totp") {
+						c.RequireTOTP = true
+					}
 					db := getDB(c)
 					initData(c)
 
@@ -110,24 +131,51 @@ func main() {
 						}
 					}()
 
-					router := gin.Default()
-					router.SetTrustedProxies(c.TrustedProxies)
+					// Collections expire independently of their files.
+					func() {
+						rows, err := db.Query(`
+							SELECT uuid, expiry
+							FROM collection
+						`)
+						if err != nil {
+							log.Fatalf("Could not query database: %s", err.Error())
+							return
+						}
+						defer func() {
+							err := rows.Close()
+							if err != nil {
+								log.Fatalf("Unable to close rows: %s", err.Error())
+								return
+							}
+						}()
+
+						for rows.Next() {
+							var collectionuuid string
+							var expiry int64
+							if err := rows.Scan(&collectionuuid, &expiry); err != nil {
+								log.Fatalf("Could not copy values from database: %s", err.Error())
+								return
+							}
 
-					secret, err := os.ReadFile(c.SessionSecretFile)
+							watchCollection(collectionuuid, time.Unix(expiry, 0), db)
+						}
+						if err = rows.Err(); err != nil {
+							log.Fatalf("Error encountered during iteration: %s", err.Error())
+							return
+						}
+					}()
 
-					if err != nil {
-						log.Fatal(err)
-					}
+					router := gin.Default()
+					router.SetTrustedProxies(c.TrustedProxies)
 
-					if len(secret) == 0 {
-						log.Fatal("Secret cannot be empty")
-					}
+					secret := readSecret(c)
 
-					store := cookie.NewStore(secret)
+					store := newStore(db, time.Duration(c.SessionIdle)*time.Second, time.Duration(c.SessionMaxAge)*time.Second, secret)
+					go store.collect(time.Hour)
 
 					router.Use(sessions.Sessions("session", store))
 
-					register(router, db, c.Data, c.InlineTypes, c.ChunkSize, c.Timeout)
+					register(router, db, c, secret)
 
 					if err := router.Run(c.Address); err != nil {
 						log.Fatal(err)
@@ -139,11 +187,23 @@ func main() {
 			{
 				Name:  "register",
 				Usage: "create a new user",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "role",
+						Usage: "role of the new user (admin, user, uploader or reader)",
+						Value: roleUser,
+					},
+				},
 				Action: func(ctx *cli.Context) error {
 					readConfig(cf, paths, toml.Unmarshal, &c)
 					db := getDB(c)
 					initData(c)
 
+					role := ctx.String("role")
+					if !validRole(role) {
+						return fmt.Errorf("invalid role %s", role)
+					}
+
 					for _, name := range ctx.Args().Slice() {
 						fmt.Fprintf(os.Stderr, "Enter password for new user %s: ", name)
 						bytePassword, err := term.ReadPassword(int(syscall.Stdin))
@@ -151,18 +211,145 @@ func main() {
 						if err != nil {
 							return err
 						}
-						hashedPassword, err := bcrypt.GenerateFromPassword(bytePassword, 12)
+						_, err = createUser(db, name, string(bytePassword), role)
 						if err != nil {
 							return err
 						}
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "invite",
+				Usage: "create an invitation link for a new user",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "role",
+						Usage: "role of the invited user (admin, user, uploader or reader)",
+						Value: roleUser,
+					},
+					&cli.StringFlag{
+						Name:  "quota",
+						Usage: "limit the total size of the files of the invited user, e.g. 10G",
+					},
+					&cli.DurationFlag{
+						Name:  "expiry",
+						Usage: "how long the invitation can be used",
+						Value: 7 * 24 * time.Hour,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					readConfig(cf, paths, toml.Unmarshal, &c)
+					db := getDB(c)
+					initData(c)
 
-						_, err = db.Exec(`
-							INSERT INTO user (name, password)
-							VALUES (?, ?)
-						`, name, hashedPassword)
+					var quota sql.NullInt64
+					if ctx.String("quota") != "" {
+						n, err := parseSize(ctx.String("quota"))
 						if err != nil {
 							return err
 						}
+						quota = sql.NullInt64{
+							Int64: n,
+							Valid: true,
+						}
+					}
+
+					token, err := createInvitation(db, sql.NullInt64{}, ctx.String("role"), quota, time.Now().Add(ctx.Duration("expiry")))
+					if err != nil {
+						return err
+					}
+
+					fmt.Println(strings.TrimSuffix(c.URL, "/") + "/invite/" + token)
+
+					return nil
+				},
+			},
+			{
+				Name:      "sign",
+				Usage:     "create a signed download URL for a file",
+				ArgsUsage: "<file>",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "expiry",
+						Usage: "how long the URL can be used",
+						Value: signedExpiry,
+					},
+					&cli.StringFlag{
+						Name:  "ip",
+						Usage: "only allow downloads from this IP address",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					readConfig(cf, paths, toml.Unmarshal, &c)
+					db := getDB(c)
+					initData(c)
+
+					if ctx.NArg() != 1 {
+						return errors.New("expected the UUID of a file")
+					}
+
+					if ctx.Duration("expiry") <= 0 {
+						return errors.New("the expiry has to be positive")
+					}
+
+					fileuuid := ctx.Args().First()
+
+					var done bool
+					err := db.QueryRow(`
+						SELECT done
+						FROM file
+						WHERE uuid = ?
+					`, fileuuid).Scan(&done)
+					if err != nil || !done {
+						return fmt.Errorf("no such file %s", fileuuid)
+					}
+
+					path, err := signedPath(db, deriveKey(readSecret(c), "sign"), fileuuid, time.Now().Add(ctx.Duration("expiry")), ctx.String("ip"))
+					if err != nil {
+						return err
+					}
+
+					fmt.Println(strings.TrimSuffix(c.URL, "/") + path)
+
+					return nil
+				},
+			},
+			{
+				Name:      "role",
+				Usage:     "change the role of an existing user",
+				ArgsUsage: "<name> <role>",
+				Action: func(ctx *cli.Context) error {
+					readConfig(cf, paths, toml.Unmarshal, &c)
+					db := getDB(c)
+					initData(c)
+
+					if ctx.NArg() != 2 {
+						return errors.New("expected a user name and a role")
+					}
+
+					name := ctx.Args().Get(0)
+					role := ctx.Args().Get(1)
+					if !validRole(role) {
+						return fmt.Errorf("invalid role %s", role)
+					}
+
+					res, err := db.Exec(`
+						UPDATE user
+						SET role = ?
+						WHERE name = ?
+					`, role, name)
+					if err != nil {
+						return err
+					}
+
+					n, err := res.RowsAffected()
+					if err != nil {
+						return err
+					}
+					if n == 0 {
+						return fmt.Errorf("no such user %s", name)
 					}
 
 					return nil
@@ -170,18 +357,37 @@ func main() {
 			},
 			{
 				Name:  "revoke",
-				Usage: "delete an existing user",
+				Usage: "delete an existing user along with their files",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "reassign",
+						Usage: "hand the files of the deleted users over to this user instead of deleting them",
+					},
+				},
 				Action: func(ctx *cli.Context) error {
 					readConfig(cf, paths, toml.Unmarshal, &c)
 					db := getDB(c)
 					initData(c)
 
+					var heir sql.NullInt64
+					if name := ctx.String("reassign"); name != "" {
+						id, err := lookupUser(db, name)
+						if err != nil {
+							return fmt.Errorf("%s: %w", name, err)
+						}
+						heir = sql.NullInt64{
+							Int64: int64(id),
+							Valid: true,
+						}
+					}
+
 					for _, name := range ctx.Args().Slice() {
-						_, err := db.Exec(`
-							DELETE FROM user
-							WHERE id = ?
-						`, name)
+						id, err := lookupUser(db, name)
 						if err != nil {
+							return fmt.Errorf("%s: %w", name, err)
+						}
+
+						if err := deleteUser(db, c.Data, id, heir); err != nil {
 							return err
 						}
 					}
@@ -231,6 +437,20 @@ func readConfig(path string, paths []string, unmarshal func(data []byte, v inter
 	}
 }
 
+func readSecret(c config) []byte {
+	secret, err := os.ReadFile(c.SessionSecretFile)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(secret) == 0 {
+		log.Fatal("Secret cannot be empty")
+	}
+
+	return secret
+}
+
 func getDB(c config) *sql.DB {
 	db, err := sql.Open("sqlite3", c.DatabaseFile)
 	if err != nil {
@@ -268,11 +488,206 @@ func initDB(db *sql.DB) error {
 			done INTEGER NOT NULL,
 			owner_id INTEGER NOT NULL REFERENCES user(id)
 		);
+
+		CREATE TABLE IF NOT EXISTS recovery_code(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES user(id),
+			code TEXT NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS session(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token TEXT NOT NULL,
+			user_id INTEGER REFERENCES user(id),
+			data BLOB NOT NULL,
+			created INTEGER NOT NULL,
+			accessed INTEGER NOT NULL,
+			address TEXT NOT NULL,
+			agent TEXT NOT NULL,
+			UNIQUE(token)
+		);
+
+		CREATE TABLE IF NOT EXISTS share(
+			file_uuid CHAR(32) NOT NULL REFERENCES file(uuid),
+			user_id INTEGER NOT NULL REFERENCES user(id),
+			permission TEXT NOT NULL,
+			UNIQUE(file_uuid, user_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS collection(
+			uuid CHAR(32) PRIMARY KEY,
+			name TEXT NOT NULL,
+			owner_id INTEGER NOT NULL REFERENCES user(id),
+			expiry INTEGER NOT NULL,
+			password TEXT,
+			created INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS collection_file(
+			collection_uuid CHAR(32) NOT NULL REFERENCES collection(uuid),
+			file_uuid CHAR(32) NOT NULL REFERENCES file(uuid),
+			UNIQUE(collection_uuid, file_uuid)
+		);
+
+		CREATE TABLE IF NOT EXISTS request(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token TEXT NOT NULL,
+			owner_id INTEGER NOT NULL REFERENCES user(id),
+			name TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			expiry INTEGER NOT NULL,
+			max_size INTEGER,
+			max_files INTEGER,
+			password TEXT,
+			UNIQUE(token)
+		);
+
+		CREATE TABLE IF NOT EXISTS invitation(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token TEXT NOT NULL,
+			creator_id INTEGER REFERENCES user(id),
+			role TEXT NOT NULL,
+			quota INTEGER,
+			created INTEGER NOT NULL,
+			expiry INTEGER NOT NULL,
+			used INTEGER,
+			user_id INTEGER REFERENCES user(id),
+			address TEXT,
+			UNIQUE(token)
+		);
+
+		CREATE TABLE IF NOT EXISTS api_token(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token TEXT NOT NULL,
+			user_id INTEGER NOT NULL REFERENCES user(id),
+			name TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			used INTEGER,
+			UNIQUE(token)
+		);
+
+		CREATE TABLE IF NOT EXISTS alias(
+			name TEXT NOT NULL COLLATE NOCASE,
+			file_uuid CHAR(32) NOT NULL REFERENCES file(uuid),
+			vanity INTEGER NOT NULL,
+			created INTEGER NOT NULL,
+			UNIQUE(name)
+		);
 	`)
 
 	if err != nil {
 		return err
 	}
 
+	return migrate(db)
+}
+
+// Each migration is applied once, in order, and tracked via user_version.
+var migrations = []string{
+	`
+		ALTER TABLE user ADD COLUMN totp_secret TEXT;
+		ALTER TABLE user ADD COLUMN totp_step INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE user ADD COLUMN provider TEXT;
+		ALTER TABLE user ADD COLUMN subject TEXT;
+		CREATE UNIQUE INDEX user_identity ON user(provider, subject);
+	`,
+	`
+		ALTER TABLE user ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+	`,
+	`
+		ALTER TABLE user ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE user ADD COLUMN display_name TEXT;
+		ALTER TABLE user ADD COLUMN email TEXT;
+		ALTER TABLE user ADD COLUMN expiry_time INTEGER NOT NULL DEFAULT 1;
+		ALTER TABLE user ADD COLUMN expiry_unit TEXT NOT NULL DEFAULT 'days';
+		ALTER TABLE user ADD COLUMN password_policy TEXT NOT NULL DEFAULT 'optional';
+	`,
+	`
+		ALTER TABLE user ADD COLUMN quota INTEGER;
+		ALTER TABLE file ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE file ADD COLUMN request_id INTEGER REFERENCES request(id);
+	`,
+	`
+		ALTER TABLE file ADD COLUMN downloads INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE file ADD COLUMN max_downloads INTEGER;
+	`,
+	`
+		ALTER TABLE file ADD COLUMN language TEXT;
+	`,
+	`
+		ALTER TABLE file ADD COLUMN strip INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE file ADD COLUMN stripped INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE file ADD COLUMN hash TEXT;
+	`,
+	`
+		ALTER TABLE alias ADD COLUMN password TEXT;
+		ALTER TABLE alias ADD COLUMN expiry INTEGER;
+		ALTER TABLE alias ADD COLUMN downloads INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE alias ADD COLUMN max_downloads INTEGER;
+	`,
+	`
+		ALTER TABLE user ADD COLUMN totp_failures INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE user ADD COLUMN totp_locked INTEGER;
+	`,
+	// Files used to be downloaded by their UUID, so links handed out before
+	// keep working as links of their own, which can be revoked. They are
+	// created at 0 so that they can be told apart and are never handed out.
+	`
+		INSERT OR IGNORE INTO alias (name, file_uuid, vanity, created)
+		SELECT uuid, uuid, FALSE, 0
+		FROM file
+		WHERE done;
+	`,
+}
+
+// Some migrations are completed in Go, after their SQL has been applied.
+var completions = map[int]func(tx *sql.Tx) error{
+	// Links used to be created when a file was first shown, so older files
+	// may not have one yet.
+	12: linkFiles,
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		if complete, ok := completions[i+1]; ok {
+			if err := complete(tx); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(io.Discard)
+
+	os.Exit(m.Run())
+}
+
+// testDB returns a fresh database with all migrations applied.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "hiraeth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// testFile writes a finished file owned by a user and returns its UUID.
+func testFile(t *testing.T, db *sql.DB, data string, owner int, name string, content string) string {
+	t.Helper()
+
+	fileuuid := name + "-uuid"
+	if err := os.WriteFile(filepath.Join(data, fileuuid), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO file (uuid, name, expiry, done, owner_id, size)
+		VALUES (?, ?, strftime('%s', 'now') + 3600, TRUE, ?, ?)
+	`, fileuuid, name, owner, len(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fileuuid
+}
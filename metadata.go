@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+var errFormat = errors.New("malformed image")
+
+var (
+	jpegMagic = []byte{0xff, 0xd8}
+	pngMagic  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// stripMetadata removes EXIF, XMP and IPTC metadata from a JPEG, PNG or WebP
+// image in place. The image data is copied as it is, so that the pixels stay
+// untouched. It reports whether the file is an image of one of these formats.
+func stripMetadata(path string) (bool, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	r := bufio.NewReader(src)
+
+	head, err := r.Peek(12)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+
+	var strip func(io.Writer) error
+	switch {
+	case bytes.HasPrefix(head, jpegMagic):
+		strip = func(w io.Writer) error {
+			return stripJPEG(w, r)
+		}
+	case bytes.HasPrefix(head, pngMagic):
+		strip = func(w io.Writer) error {
+			return stripPNG(w, r)
+		}
+	case len(head) == 12 && string(head[:4]) == "RIFF" && string(head[8:]) == "WEBP":
+		// The size of the file is stored in its header, so it has to be read
+		// twice.
+		strip = func(w io.Writer) error {
+			return stripWebP(w, src)
+		}
+	default:
+		return false, nil
+	}
+
+	tmp := path + ".strip"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+
+	w := bufio.NewWriter(dst)
+	err = strip(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+
+	return true, os.Rename(tmp, path)
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// The EXIF tag telling how an image has to be rotated or flipped to be shown
+// upright.
+const orientationTag = 0x0112
+
+// orientation returns the value of the orientation tag in the first IFD of
+// EXIF data, or 0 if there is none.
+func orientation(exif []byte) uint16 {
+	tiff, ok := bytes.CutPrefix(exif, exifHeader)
+	if !ok || len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int64(order.Uint32(tiff[4:8]))
+	if offset+2 > int64(len(tiff)) {
+		return 0
+	}
+
+	entries := int64(order.Uint16(tiff[offset:]))
+	for i := int64(0); i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			return 0
+		}
+
+		// The orientation is a single short, which is stored in the entry
+		// itself.
+		if order.Uint16(tiff[entry:]) == orientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			return order.Uint16(tiff[entry+8:])
+		}
+	}
+
+	return 0
+}
+
+// orientationEXIF builds EXIF data which holds nothing but the orientation of
+// an image.
+func orientationEXIF(o uint16) []byte {
+	var b bytes.Buffer
+	b.Write(exifHeader)
+	b.WriteString("MM")
+	binary.Write(&b, binary.BigEndian, []uint16{42})
+	binary.Write(&b, binary.BigEndian, []uint32{8})
+	binary.Write(&b, binary.BigEndian, []uint16{1, orientationTag, 3})
+	binary.Write(&b, binary.BigEndian, []uint32{1})
+	binary.Write(&b, binary.BigEndian, []uint16{o, 0})
+	binary.Write(&b, binary.BigEndian, []uint32{0})
+	return b.Bytes()
+}
+
+// stripJPEG drops the APP1 (EXIF and XMP) and APP13 (IPTC) segments in front of
+// the image data. The orientation is kept in an EXIF segment of its own, since
+// images would otherwise be shown rotated.
+func stripJPEG(w io.Writer, r *bufio.Reader) error {
+	if _, err := io.CopyN(w, r, 2); err != nil {
+		return err
+	}
+
+	var kept bool
+	for {
+		marker := make([]byte, 2)
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return errFormat
+		}
+		if marker[0] != 0xff {
+			return errFormat
+		}
+
+		// Markers may be preceded by any number of fill bytes.
+		for marker[1] == 0xff {
+			b, err := r.ReadByte()
+			if err != nil {
+				return errFormat
+			}
+			marker[1] = b
+		}
+
+		// These markers stand on their own.
+		if marker[1] == 0x01 || (marker[1] >= 0xd0 && marker[1] <= 0xd8) {
+			if _, err := w.Write(marker); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Everything after the end of image or the start of the image data is
+		// kept as it is.
+		if marker[1] == 0xd9 || marker[1] == 0xda {
+			if _, err := w.Write(marker); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, r)
+			return err
+		}
+
+		size := make([]byte, 2)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return errFormat
+		}
+		n := int64(binary.BigEndian.Uint16(size))
+		if n < 2 {
+			return errFormat
+		}
+
+		var data []byte
+		if marker[1] == 0xe1 || marker[1] == 0xed {
+			segment := make([]byte, n-2)
+			if _, err := io.ReadFull(r, segment); err != nil {
+				return errFormat
+			}
+
+			o := orientation(segment)
+			if marker[1] != 0xe1 || o <= 1 || kept {
+				continue
+			}
+			kept = true
+
+			exif := orientationEXIF(o)
+			binary.BigEndian.PutUint16(size, uint16(len(exif)+2))
+			data = exif
+		}
+
+		if _, err := w.Write(marker); err != nil {
+			return err
+		}
+		if _, err := w.Write(size); err != nil {
+			return err
+		}
+		if data != nil {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.CopyN(w, r, n-2); err != nil {
+			return errFormat
+		}
+	}
+}
+
+// stripPNG drops the eXIf chunk and all textual chunks, which is where XMP is
+// stored.
+func stripPNG(w io.Writer, r *bufio.Reader) error {
+	if _, err := io.CopyN(w, r, int64(len(pngMagic))); err != nil {
+		return err
+	}
+
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return errFormat
+		}
+
+		// The chunk data is followed by a checksum.
+		n := int64(binary.BigEndian.Uint32(header[:4])) + 4
+
+		switch string(header[4:]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+			if _, err := io.CopyN(io.Discard, r, n); err != nil {
+				return errFormat
+			}
+			continue
+		}
+
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, n); err != nil {
+			return errFormat
+		}
+
+		if string(header[4:]) == "IEND" {
+			return nil
+		}
+	}
+}
+
+// stripWebP drops the EXIF and XMP chunks and clears the flags announcing them.
+func stripWebP(w io.Writer, src *os.File) error {
+	// visit calls a function with the header of each chunk and a reader for
+	// its data, which includes the padding.
+	visit := func(r *bufio.Reader, f func(chunk []byte, data io.Reader) error) error {
+		for {
+			chunk := make([]byte, 8)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return errFormat
+			}
+
+			n := int64(binary.LittleEndian.Uint32(chunk[4:]))
+			n += n % 2
+
+			data := io.LimitReader(r, n)
+			if err := f(chunk, data); err != nil {
+				return err
+			}
+			if _, err := io.Copy(io.Discard, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	dropped := func(chunk []byte) bool {
+		return string(chunk[:4]) == "EXIF" || string(chunk[:4]) == "XMP "
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return errFormat
+	}
+
+	var removed uint32
+	err := visit(bufio.NewReader(src), func(chunk []byte, data io.Reader) error {
+		if dropped(chunk) {
+			n := binary.LittleEndian.Uint32(chunk[4:])
+			removed += 8 + n + n%2
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	size := binary.LittleEndian.Uint32(header[4:8])
+	if removed > size {
+		return errFormat
+	}
+	binary.LittleEndian.PutUint32(header[4:8], size-removed)
+
+	if _, err := src.Seek(int64(len(header)), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	return visit(bufio.NewReader(src), func(chunk []byte, data io.Reader) error {
+		if dropped(chunk) {
+			return nil
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+
+		if string(chunk[:4]) == "VP8X" {
+			flags := make([]byte, 1)
+			if _, err := io.ReadFull(data, flags); err != nil {
+				return errFormat
+			}
+			flags[0] &^= 0x08 | 0x04
+			if _, err := w.Write(flags); err != nil {
+				return err
+			}
+		}
+
+		_, err := io.Copy(w, data)
+		return err
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metric writes a single sample in the Prometheus text format.
+func metric(w *bytes.Buffer, name string, kind string, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func registerMetrics(router *gin.Engine, c config, t *throttle) {
+	if c.MetricsTokenFile == "" {
+		return
+	}
+
+	token, err := os.ReadFile(c.MetricsTokenFile)
+	if err != nil {
+		log.Fatalf("Unable to read metrics token: %s", err.Error())
+	}
+	token = bytes.TrimSpace(token)
+	if len(token) == 0 {
+		log.Fatal("The metrics token is empty")
+	}
+
+	router.GET("/metrics", func(ctx *gin.Context) {
+		given := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), token) != 1 {
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		var w bytes.Buffer
+
+		metric(&w, "hiraeth_sent_bytes_total", "counter", "Bytes sent in downloads.", t.sent.total.Load())
+		metric(&w, "hiraeth_sent_bytes_per_second", "gauge", "Bytes sent in downloads during the last second.", t.sent.rate.Load())
+		metric(&w, "hiraeth_received_bytes_total", "counter", "Bytes received in uploads.", t.received.total.Load())
+		metric(&w, "hiraeth_received_bytes_per_second", "gauge", "Bytes received in uploads during the last second.", t.received.rate.Load())
+
+		downloads, active := t.downloading()
+		metric(&w, "hiraeth_downloads", "gauge", "Downloads in progress.", int64(downloads))
+
+		w.WriteString("# HELP hiraeth_file_downloads Downloads in progress by file.\n")
+		w.WriteString("# TYPE hiraeth_file_downloads gauge\n")
+		for fileuuid, n := range active {
+			fmt.Fprintf(&w, "hiraeth_file_downloads{file=%q} %d\n", fileuuid, n)
+		}
+
+		ctx.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", w.Bytes())
+	})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+type oidcConfig struct {
+	Issuer           string            `toml:"issuer"`
+	ClientID         string            `toml:"client_id"`
+	ClientSecretFile string            `toml:"client_secret_file"`
+	RedirectURL      string            `toml:"redirect_url"`
+	Scopes           []string          `toml:"scopes"`
+	NameClaim        string            `toml:"name_claim"`
+	GroupsClaim      string            `toml:"groups_claim"`
+	Groups           []string          `toml:"groups"`
+	Roles            map[string]string `toml:"roles"`
+}
+
+func randomString(n int) string {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		log.Fatalf("Unable to read random bytes: %s", err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// stringClaim and groupsClaim pick values out of the raw claims, since the
+// claim names are configurable.
+func stringClaim(claims map[string]interface{}, name string) string {
+	v, _ := claims[name].(string)
+	return v
+}
+
+func groupsClaim(claims map[string]interface{}, name string) []string {
+	var groups []string
+	switch v := claims[name].(type) {
+	case string:
+		groups = append(groups, v)
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	return groups
+}
+
+func registerOIDC(router *gin.Engine, db *sql.DB, oc oidcConfig) {
+	if oc.Issuer == "" {
+		return
+	}
+
+	clientSecret, err := os.ReadFile(oc.ClientSecretFile)
+	if err != nil {
+		log.Fatalf("Unable to read OIDC client secret: %s", err.Error())
+	}
+
+	nameClaim := oc.NameClaim
+	if nameClaim == "" {
+		nameClaim = "preferred_username"
+	}
+
+	groupsClaimName := oc.GroupsClaim
+	if groupsClaimName == "" {
+		groupsClaimName = "groups"
+	}
+
+	scopes := oc.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+
+	// The provider is discovered lazily, so that hiraeth still starts while the
+	// identity provider is unreachable.
+	var (
+		mu       sync.Mutex
+		provider *oidc.Provider
+	)
+	discover := func(ctx context.Context) (*oidc.Provider, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if provider != nil {
+			return provider, nil
+		}
+
+		p, err := oidc.NewProvider(ctx, oc.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		provider = p
+
+		return provider, nil
+	}
+
+	oauth := func(p *oidc.Provider) *oauth2.Config {
+		return &oauth2.Config{
+			ClientID:     oc.ClientID,
+			ClientSecret: strings.TrimSpace(string(clientSecret)),
+			RedirectURL:  oc.RedirectURL,
+			Endpoint:     p.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		}
+	}
+
+	router.GET("/login/oidc", func(ctx *gin.Context) {
+		p, err := discover(ctx)
+		if err != nil {
+			log.Printf("Unable to discover OIDC provider: %s", err.Error())
+			ctx.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+
+		state := randomString(32)
+		nonce := randomString(32)
+		verifier := oauth2.GenerateVerifier()
+
+		session := sessions.Default(ctx)
+		session.Set("oidc_state", state)
+		session.Set("oidc_nonce", nonce)
+		session.Set("oidc_verifier", verifier)
+		err = session.Save()
+		if err != nil {
+			log.Printf("Could not save data to session: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		ctx.Redirect(http.StatusFound, oauth(p).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)))
+	})
+
+	router.GET("/login/oidc/callback", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		state, _ := session.Get("oidc_state").(string)
+		nonce, _ := session.Get("oidc_nonce").(string)
+		verifier, _ := session.Get("oidc_verifier").(string)
+
+		session.Delete("oidc_state")
+		session.Delete("oidc_nonce")
+		session.Delete("oidc_verifier")
+		session.Save()
+
+		if state == "" || ctx.Query("state") != state {
+			log.Printf("OIDC state mismatch")
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		if e := ctx.Query("error"); e != "" {
+			log.Printf("OIDC provider returned an error: %s", e)
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		p, err := discover(ctx)
+		if err != nil {
+			log.Printf("Unable to discover OIDC provider: %s", err.Error())
+			ctx.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+
+		token, err := oauth(p).Exchange(ctx, ctx.Query("code"), oauth2.VerifierOption(verifier))
+		if err != nil {
+			log.Printf("Unable to exchange authorization code: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		raw, ok := token.Extra("id_token").(string)
+		if !ok {
+			log.Printf("Token response does not contain an ID token")
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		idToken, err := p.Verifier(&oidc.Config{ClientID: oc.ClientID}).Verify(ctx, raw)
+		if err != nil {
+			log.Printf("Unable to verify ID token: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		if idToken.Nonce != nonce {
+			log.Printf("OIDC nonce mismatch")
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		var claims map[string]interface{}
+		if err := idToken.Claims(&claims); err != nil {
+			log.Printf("Unable to decode claims: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		groups := groupsClaim(claims, groupsClaimName)
+
+		if len(oc.Groups) > 0 && !intersects(groups, oc.Groups) {
+			log.Printf("Subject %s is not in any of the permitted groups", idToken.Subject)
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		userid, err := provision(db, "oidc", idToken.Subject, stringClaim(claims, nameClaim))
+		if err != nil {
+			log.Printf("Unable to provision user: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		row := db.QueryRow(`
+			SELECT disabled
+			FROM user
+			WHERE id = ?
+		`, userid)
+
+		var disabled bool
+		if err := row.Scan(&disabled); err != nil || disabled {
+			log.Printf("User %d is not allowed to log in", userid)
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		// Roles follow the group memberships on every login if a mapping is configured.
+		if len(oc.Roles) > 0 {
+			role := mapRole(groups, oc.Roles)
+			if role == "" {
+				role = roleUser
+			}
+			if err := assignRole(db, userid, role); err != nil {
+				log.Printf("Unable to update role: %s", err.Error())
+			}
+		}
+
+		session.Set("user_id", userid)
+		err = session.Save()
+		if err != nil {
+			log.Printf("Could not save data to session: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		ctx.Redirect(http.StatusFound, "/files/")
+	})
+}
+
+func intersects(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// testProvider is a minimal OpenID provider, which issues ID tokens for a
+// fixed subject to whoever presents a code it handed out.
+type testProvider struct {
+	*httptest.Server
+
+	key      *rsa.PrivateKey
+	subject  string
+	name     string
+	mu       sync.Mutex
+	requests map[string]url.Values
+	tokens   int
+}
+
+func newTestProvider(t *testing.T, subject string, name string) *testProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testProvider{
+		key:      key,
+		subject:  subject,
+		name:     name,
+		requests: map[string]url.Values{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		p.tokens++
+
+		code := r.PostFormValue("code")
+		q, ok := p.requests[code]
+		delete(p.requests, code)
+
+		// Codes are only redeemed with the verifier of their challenge.
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || q.Get("code_challenge_method") != "S256" || base64.RawURLEncoding.EncodeToString(sum[:]) != q.Get("code_challenge") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token": p.sign(t, map[string]interface{}{
+				"iss":                p.URL,
+				"sub":                p.subject,
+				"aud":                q.Get("client_id"),
+				"exp":                time.Now().Add(time.Hour).Unix(),
+				"iat":                time.Now().Unix(),
+				"nonce":              q.Get("nonce"),
+				"preferred_username": p.name,
+			}),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func (p *testProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize lets the user through, as if they had logged in at the provider,
+// and returns the code to be passed to the callback.
+func (p *testProvider) authorize(t *testing.T, location string) (string, url.Values) {
+	t.Helper()
+
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != p.Listener.Addr().String() || u.Path != "/authorize" {
+		t.Fatalf("redirected to %s instead of the provider", location)
+	}
+
+	q := u.Query()
+	code := randomString(16)
+
+	p.mu.Lock()
+	p.requests[code] = q
+	p.mu.Unlock()
+
+	return code, q
+}
+
+// oidcClient talks to hiraeth like a browser would, keeping its session.
+type oidcClient struct {
+	server *httptest.Server
+	client *http.Client
+}
+
+func newOIDCClient(t *testing.T, db *sql.DB, p *testProvider) *oidcClient {
+	t.Helper()
+
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "client_secret")
+	if err := os.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.Use(sessions.Sessions("session", newStore(db, time.Hour, time.Hour, []byte("test"))))
+	registerOIDC(router, db, oidcConfig{
+		Issuer:           p.URL,
+		ClientID:         "hiraeth",
+		ClientSecretFile: secretFile,
+		RedirectURL:      "http://hiraeth.test/login/oidc/callback",
+	})
+	router.GET("/whoami", func(ctx *gin.Context) {
+		userid, _ := sessions.Default(ctx).Get("user_id").(int)
+		ctx.JSON(http.StatusOK, gin.H{"id": userid})
+	})
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &oidcClient{
+		server: server,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (c *oidcClient) get(t *testing.T, path string) *http.Response {
+	t.Helper()
+
+	res, err := c.client.Get(c.server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res
+}
+
+func (c *oidcClient) whoami(t *testing.T) int {
+	t.Helper()
+
+	res, err := c.client.Get(c.server.URL + "/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var out struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.ID
+}
+
+// login goes through the whole flow and returns the callback response.
+func (c *oidcClient) login(t *testing.T, p *testProvider) *http.Response {
+	t.Helper()
+
+	res := c.get(t, "/login/oidc")
+	code, q := p.authorize(t, res.Header.Get("Location"))
+
+	return c.get(t, "/login/oidc/callback?"+url.Values{
+		"code":  {code},
+		"state": {q.Get("state")},
+	}.Encode())
+}
+
+func TestOIDCLogin(t *testing.T) {
+	db := testDB(t)
+	p := newTestProvider(t, "subject-1", "carol")
+	c := newOIDCClient(t, db, p)
+
+	res := c.login(t, p)
+	if location := res.Header.Get("Location"); location != "/files/" {
+		t.Fatalf("login redirected to %q", location)
+	}
+
+	userid := c.whoami(t)
+	if userid == 0 {
+		t.Fatal("no user in session after login")
+	}
+
+	var (
+		name     string
+		provider string
+		subject  string
+	)
+	err := db.QueryRow(`
+		SELECT name, provider, subject
+		FROM user
+		WHERE id = ?
+	`, userid).Scan(&name, &provider, &subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "carol" || provider != "oidc" || subject != "subject-1" {
+		t.Fatalf("provisioned %s (%s %s)", name, provider, subject)
+	}
+
+	// Logging in again uses the same user, even if the name has changed.
+	p.name = "caroline"
+	other := newOIDCClient(t, db, p)
+	other.login(t, p)
+	if id := other.whoami(t); id != userid {
+		t.Fatalf("second login ended up as user %d instead of %d", id, userid)
+	}
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM user`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("%d users after logging in twice", n)
+	}
+}
+
+func TestOIDCState(t *testing.T) {
+	db := testDB(t)
+	p := newTestProvider(t, "subject-1", "carol")
+
+	tests := []struct {
+		name  string
+		state func(state string) string
+	}{
+		{"missing", func(string) string { return "" }},
+		{"wrong", func(string) string { return "forged" }},
+		{"truncated", func(state string) string { return state[:len(state)-1] }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newOIDCClient(t, db, p)
+
+			res := c.get(t, "/login/oidc")
+			code, q := p.authorize(t, res.Header.Get("Location"))
+
+			p.mu.Lock()
+			tokens := p.tokens
+			p.mu.Unlock()
+
+			res = c.get(t, "/login/oidc/callback?"+url.Values{
+				"code":  {code},
+				"state": {tt.state(q.Get("state"))},
+			}.Encode())
+			if location := res.Header.Get("Location"); location != "/" {
+				t.Fatalf("callback redirected to %q", location)
+			}
+			if id := c.whoami(t); id != 0 {
+				t.Fatalf("logged in as user %d", id)
+			}
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.tokens != tokens {
+				t.Fatal("code was redeemed despite the state mismatch")
+			}
+		})
+	}
+
+	// The state can only be used once.
+	t.Run("replayed", func(t *testing.T) {
+		c := newOIDCClient(t, db, p)
+
+		res := c.get(t, "/login/oidc")
+		location := res.Header.Get("Location")
+		code, q := p.authorize(t, location)
+		c.get(t, "/login/oidc/callback?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode())
+
+		p.mu.Lock()
+		tokens := p.tokens
+		p.mu.Unlock()
+
+		code, _ = p.authorize(t, location)
+		res = c.get(t, "/login/oidc/callback?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode())
+		if location := res.Header.Get("Location"); location != "/" {
+			t.Fatalf("callback redirected to %q", location)
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.tokens != tokens {
+			t.Fatal("code was redeemed with a state which had already been used")
+		}
+	})
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	db := testDB(t)
+	p := newTestProvider(t, "subject-1", "carol")
+	c := newOIDCClient(t, db, p)
+
+	res := c.get(t, "/login/oidc")
+	code, q := p.authorize(t, res.Header.Get("Location"))
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without PKCE: %v", q)
+	}
+
+	// A code intercepted by someone else cannot be redeemed without the
+	// verifier kept in the session of the user.
+	p.mu.Lock()
+	p.requests[code].Set("code_challenge", "intercepted")
+	p.mu.Unlock()
+
+	res = c.get(t, "/login/oidc/callback?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode())
+	if location := res.Header.Get("Location"); location != "/" {
+		t.Fatalf("callback redirected to %q", location)
+	}
+	if id := c.whoami(t); id != 0 {
+		t.Fatalf("logged in as user %d", id)
+	}
+}
+
+func TestOIDCDisabled(t *testing.T) {
+	db := testDB(t)
+	p := newTestProvider(t, "subject-1", "carol")
+
+	userid, err := provision(db, "oidc", "subject-1", "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := disableUser(db, userid, true); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newOIDCClient(t, db, p)
+	res := c.login(t, p)
+	if location := res.Header.Get("Location"); location != "/" {
+		t.Fatalf("login redirected to %q", location)
+	}
+	if id := c.whoami(t); id != 0 {
+		t.Fatalf("disabled user logged in as %d", id)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Pastes are files created from text entered in the browser. They are stored
+// like any other file, except that their language is recorded, so that they
+// can be shown with syntax highlighting.
+const (
+	maxPaste      = 1 << 20
+	plainLanguage = "plaintext"
+)
+
+var highlighter = html.New(html.WithClasses(true), html.WithLineNumbers(true))
+
+// highlightCSS contains the styles of highlighted pastes for both light and
+// dark color schemes.
+func highlightCSS() (string, error) {
+	var buf bytes.Buffer
+
+	buf.WriteString("@media (prefers-color-scheme: light) {\n")
+	if err := highlighter.WriteCSS(&buf, styles.Get("github")); err != nil {
+		return "", err
+	}
+	buf.WriteString("}\n@media (prefers-color-scheme: dark) {\n")
+	if err := highlighter.WriteCSS(&buf, styles.Get("monokai")); err != nil {
+		return "", err
+	}
+	buf.WriteString("}\n")
+
+	return buf.String(), nil
+}
+
+func highlight(content string, language string) (template.HTML, error) {
+	lexer := lexers.Get(language)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, content)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := highlighter.Format(&buf, styles.Get("github"), iterator); err != nil {
+		return "", err
+	}
+
+	return template.HTML(buf.String()), nil
+}
+
+// pasteName derives a filename from the language of a paste if none has been
+// given.
+func pasteName(name string, language string) string {
+	if name != "" {
+		return name
+	}
+
+	if lexer := lexers.Get(language); lexer != nil {
+		for _, pattern := range lexer.Config().Filenames {
+			if ext := path.Ext(pattern); strings.HasPrefix(pattern, "*.") && !strings.ContainsAny(ext, "*?[") {
+				return "paste" + ext
+			}
+		}
+	}
+
+	return "paste.txt"
+}
+
+// showPaste renders a paste with syntax highlighting. Viewing a paste counts as
+// downloading it through the link it was opened with.
+func showPaste(ctx *gin.Context, db *sql.DB, c config, id string, fileuuid string, filename string, language string) {
+	allowed, last, err := countDownload(db, fileuuid, id)
+	if err != nil {
+		log.Printf("Unable to count download: %s", err.Error())
+		ctx.AbortWithStatus(500)
+		return
+	}
+	if !allowed {
+		ctx.Redirect(http.StatusFound, "/")
+		return
+	}
+	if last {
+		defer remove(fileuuid, c.Data, db)
+	}
+
+	content, err := os.ReadFile(filepath.Join(c.Data, fileuuid))
+	if err != nil {
+		log.Printf("Unable to read paste: %s", err.Error())
+		ctx.AbortWithStatus(500)
+		return
+	}
+
+	code, err := highlight(string(content), language)
+	if err != nil {
+		log.Printf("Unable to highlight paste: %s", err.Error())
+		ctx.AbortWithStatus(500)
+		return
+	}
+
+	ctx.HTML(http.StatusOK, "paste", gin.H{
+		"Title": filename,
+		"File": gin.H{
+			"ID":       id,
+			"Name":     filename,
+			"Language": language,
+		},
+		"Code": code,
+	})
+}
+
+func registerPastes(router *gin.Engine, priv *gin.RouterGroup, db *sql.DB, c config, up *uploader) {
+	names := lexers.Names(false)
+	languages := map[string]bool{}
+	for _, name := range names {
+		languages[name] = true
+	}
+
+	css, err := highlightCSS()
+	if err != nil {
+		log.Fatalf("Unable to generate highlighting styles: %s", err.Error())
+	}
+
+	router.GET("/highlight.css", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "text/css; charset=utf-8", []byte(css))
+	})
+
+	priv.GET("/paste", allow(roleAdmin, roleUser, roleUploader), func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		p, err := loadPreferences(db, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Could not copy values from database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		page(ctx, "new-paste", gin.H{
+			"Languages":   names,
+			"Default":     plainLanguage,
+			"Preferences": p,
+		})
+	})
+
+	priv.POST("/paste", allow(roleAdmin, roleUser, roleUploader), func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxPaste+64*1024)
+
+		var in struct {
+			Name     string `form:"name"`
+			Language string `form:"language" binding:"required"`
+			Content  string `form:"content" binding:"required"`
+			Password string `form:"password"`
+			Time     int64  `form:"time" binding:"required"`
+			Unit     string `form:"unit" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil || !languages[in.Language] || len(in.Content) > maxPaste {
+			ctx.Redirect(http.StatusFound, "/paste")
+			return
+		}
+
+		now := time.Now()
+
+		add, err := asUnit(in.Unit, time.Duration(in.Time))
+		if err != nil || in.Time < 1 || add > time.Duration(24*365)*time.Hour {
+			ctx.Redirect(http.StatusFound, "/paste")
+			return
+		}
+
+		if err := checkPolicy(db, session.Get("user_id"), in.Password); err != nil {
+			ctx.Redirect(http.StatusFound, "/paste")
+			return
+		}
+
+		password, err := hashPassword(in.Password)
+		if err != nil {
+			log.Printf("Unable to hash provided password: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/paste")
+			return
+		}
+
+		fileuuid, err := up.store(strings.NewReader(in.Content), int64(len(in.Content)), upload{
+			Name:     pasteName(in.Name, in.Language),
+			Expiry:   now.Add(add),
+			Password: password,
+			Owner:    session.Get("user_id"),
+			Language: sql.NullString{
+				String: in.Language,
+				Valid:  true,
+			},
+		})
+		if err != nil {
+			log.Printf("Unable to save paste: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/paste")
+			return
+		}
+
+		ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+	})
+}
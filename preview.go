@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/h2non/filetype"
+	"github.com/russross/blackfriday/v2"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of previews, depending on the detected type of a file.
+const (
+	previewImage    = "image"
+	previewAudio    = "audio"
+	previewVideo    = "video"
+	previewPDF      = "pdf"
+	previewMarkdown = "markdown"
+	previewText     = "text"
+	previewArchive  = "archive"
+)
+
+// detect determines the MIME type of a file and how it can be previewed.
+// Files which are not recognized are treated as text if they look like it.
+func detect(path string, filename string) (string, string, error) {
+	ft, err := filetype.MatchFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	if ft != filetype.Unknown {
+		switch {
+		case ft.MIME.Type == "image":
+			return ft.MIME.Value, previewImage, nil
+		case ft.MIME.Type == "audio":
+			return ft.MIME.Value, previewAudio, nil
+		case ft.MIME.Type == "video":
+			return ft.MIME.Value, previewVideo, nil
+		case ft.MIME.Value == "application/pdf":
+			return ft.MIME.Value, previewPDF, nil
+		default:
+			return ft.MIME.Value, "", nil
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 8192)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", "", err
+	}
+	head = head[:n]
+
+	// A multi-byte character might have been cut off at the end.
+	for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+	if n > 0 && (!utf8.Valid(head) || bytes.IndexByte(head, 0) != -1) {
+		return "application/octet-stream", "", nil
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".md", ".markdown":
+		return "text/markdown", previewMarkdown, nil
+	default:
+		return "text/plain", previewText, nil
+	}
+}
+
+// inline reports whether files of a kind are shown by the browser itself.
+func inline(kind string) bool {
+	switch kind {
+	case previewImage, previewAudio, previewVideo, previewPDF:
+		return true
+	default:
+		return false
+	}
+}
+
+func renderMarkdown(content []byte) template.HTML {
+	renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+		Flags: blackfriday.CommonHTMLFlags | blackfriday.SkipHTML | blackfriday.Safelink,
+	})
+	return template.HTML(blackfriday.Run(content, blackfriday.WithRenderer(renderer)))
+}
+
+// showPreview renders the landing page of a file, which shows what it contains
+// where possible. Unlike downloading the file, this does not count as a
+// download.
+func showPreview(ctx *gin.Context, c config, id string, fileuuid string, filename string, expiry time.Time, size int64) {
+	path := filepath.Join(c.Data, fileuuid)
+
+	mimeType, kind, err := detect(path, filename)
+	if err != nil {
+		log.Printf("Unable to detect file type: %s", err.Error())
+		ctx.AbortWithStatus(500)
+		return
+	}
+
+	h := gin.H{
+		"Title": filename,
+		"File": gin.H{
+			"ID":     id,
+			"Name":   filename,
+			"Type":   mimeType,
+			"Size":   formatSize(size),
+			"Expiry": expiry,
+		},
+		"Kind": kind,
+	}
+
+	// Text is rendered on the server, as long as it is not too large.
+	if (kind == previewMarkdown || kind == previewText) && size <= maxPaste {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Unable to read file: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		if kind == previewMarkdown {
+			h["Content"] = renderMarkdown(content)
+		} else {
+			language := plainLanguage
+			if lexer := lexers.Match(filename); lexer != nil {
+				language = lexer.Config().Name
+			}
+
+			h["Content"], err = highlight(string(content), language)
+			if err != nil {
+				log.Printf("Unable to highlight file: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+		}
+	} else if !inline(kind) {
+		h["Kind"] = ""
+
+		format, err := archiveFormat(path)
+		if err != nil {
+			log.Printf("Unable to detect archive format: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		if format != "" {
+			entries, truncated, err := listArchive(path, format)
+			if err != nil {
+				log.Printf("Unable to list archive: %s", err.Error())
+			}
+
+			h["Kind"] = previewArchive
+			h["Entries"] = entries
+			h["Truncated"] = truncated
+		}
+	}
+
+	ctx.HTML(http.StatusOK, "preview", h)
+}
+
+func registerPreviews(router *gin.Engine, db *sql.DB, c config, t *throttle) {
+	// Send the contents of a file for its preview or paste page. Pastes are
+	// sent as plain text and files which the browser can show are sent inline,
+	// unless a download has been asked for.
+	raw := func(ctx *gin.Context) {
+		id := ctx.Param("id")
+
+		l, err := lookupLink(db, id)
+		if err != nil {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+		fileuuid := l.File
+
+		row := db.QueryRow(`
+			SELECT name, password, language
+			FROM file
+			WHERE uuid = ?
+			AND done
+		`, fileuuid)
+
+		var (
+			filename string
+			password sql.NullString
+			language sql.NullString
+		)
+		if err := row.Scan(&filename, &password, &language); err != nil {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+		// The password of a link replaces the one of the file.
+		if l.Password.Valid {
+			password = l.Password
+		}
+
+		session := sessions.Default(ctx)
+		permission, err := access(db, fileuuid, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to check access: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		if permission == "" && password.Valid && !linkUnlocked(session, id) {
+			ctx.Redirect(http.StatusFound, "/downloads/"+id)
+			return
+		}
+
+		path := filepath.Join(c.Data, fileuuid)
+
+		mimeType, kind, err := detect(path, filename)
+		if err != nil {
+			log.Printf("Unable to detect file type: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		disposition := "attachment"
+		switch {
+		case ctx.Query("download") != "":
+		case language.Valid:
+			disposition = "inline"
+			mimeType = "text/plain; charset=utf-8"
+		case inline(kind):
+			disposition = "inline"
+		}
+
+		done, ok := t.begin(ctx, fileuuid)
+		if !ok {
+			return
+		}
+		defer done()
+
+		sendFile(ctx, db, c, id, fileuuid, filename, disposition, mimeType)
+	}
+
+	router.GET("/downloads/:id/raw", raw)
+	router.HEAD("/downloads/:id/raw", raw)
+}
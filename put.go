@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// putUser authenticates a request to the upload endpoint, which is meant for
+// scripts and therefore does not use sessions. Users with a second factor have
+// to use an API token instead of their password.
+func putUser(ctx *gin.Context, db *sql.DB, c config) (int, error) {
+	var (
+		userid int
+		err    error
+	)
+
+	header := ctx.GetHeader("Authorization")
+	name, password, basic := ctx.Request.BasicAuth()
+	switch {
+	case strings.HasPrefix(header, "Bearer "):
+		userid, err = tokenUser(db, strings.TrimPrefix(header, "Bearer "))
+	case basic:
+		userid, err = tokenUser(db, password)
+		if err == nil {
+			var owner string
+			err = db.QueryRow(`
+				SELECT name
+				FROM user
+				WHERE id = ?
+			`, userid).Scan(&owner)
+			if err == nil && owner != name {
+				err = errors.New("token belongs to another user")
+			}
+			break
+		}
+
+		userid, err = authenticate(db, c, name, password)
+		if err != nil {
+			break
+		}
+
+		var enrolled bool
+		err = db.QueryRow(`
+			SELECT totp_secret IS NOT NULL
+			FROM user
+			WHERE id = ?
+		`, userid).Scan(&enrolled)
+		if err == nil && enrolled {
+			err = errors.New("a token is required with two-factor authentication")
+		}
+	default:
+		err = errors.New("no credentials")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	row := db.QueryRow(`
+		SELECT role, totp_secret IS NOT NULL OR provider IS 'oidc'
+		FROM user
+		WHERE id = ?
+		AND NOT disabled
+	`, userid)
+
+	var (
+		role     string
+		enrolled bool
+	)
+	if err := row.Scan(&role, &enrolled); err != nil {
+		return 0, err
+	}
+
+	if role == roleReader {
+		return 0, errors.New("not allowed to upload")
+	}
+	if c.RequireTOTP && !enrolled {
+		return 0, errors.New("two-factor authentication has not been set up")
+	}
+
+	return userid, nil
+}
+
+// option reads a setting of the upload endpoint from the query or, if it is
+// not given there, from a header.
+func option(ctx *gin.Context, query string, header string) string {
+	if v := ctx.Query(query); v != "" {
+		return v
+	}
+	return ctx.GetHeader(header)
+}
+
+func registerPut(router *gin.Engine, db *sql.DB, c config, up *uploader, t *throttle) {
+	// Upload the request body as a file and answer with its link, so that
+	// `curl -T file https://host/put/` works.
+	router.PUT("/put/:filename", func(ctx *gin.Context) {
+		userid, err := putUser(ctx, db, c)
+		if err != nil {
+			log.Printf("Rejected upload: %s", err.Error())
+			ctx.Header("WWW-Authenticate", `Basic realm="hiraeth"`)
+			ctx.String(http.StatusUnauthorized, "Unauthorized\n")
+			return
+		}
+
+		p, err := loadPreferences(db, userid)
+		if err != nil {
+			log.Printf("Could not copy values from database: %s", err.Error())
+			ctx.String(500, "Unable to load preferences\n")
+			return
+		}
+
+		amount := p.Time
+		if v := option(ctx, "time", "Expiry-Time"); v != "" {
+			amount, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || amount < 1 {
+				ctx.String(400, "Malformed expiry time\n")
+				return
+			}
+		}
+
+		unit := p.Unit
+		if v := option(ctx, "unit", "Expiry-Unit"); v != "" {
+			unit = v
+		}
+
+		now := time.Now()
+
+		add, err := asUnit(unit, time.Duration(amount))
+		if err != nil {
+			ctx.String(400, "Cannot convert duration to unit\n")
+			return
+		}
+
+		expiry := now.Add(add)
+		if expiry.After(now.Add(time.Duration(24*365) * time.Hour)) {
+			ctx.String(400, "Duration too long\n")
+			return
+		}
+
+		var downloads sql.NullInt64
+		if v := option(ctx, "downloads", "Max-Downloads"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 {
+				ctx.String(400, "Malformed download limit\n")
+				return
+			}
+			downloads = sql.NullInt64{
+				Int64: n,
+				Valid: true,
+			}
+		}
+
+		var strip sql.NullBool
+		if v := option(ctx, "strip", "Strip-Metadata"); v != "" {
+			strip.Bool, err = strconv.ParseBool(v)
+			if err != nil {
+				ctx.String(400, "Malformed metadata option\n")
+				return
+			}
+			strip.Valid = true
+		}
+
+		plain := option(ctx, "password", "Password")
+		if err := checkPolicy(db, userid, plain); err != nil {
+			ctx.String(400, "Password required\n")
+			return
+		}
+
+		password, err := hashPassword(plain)
+		if err != nil {
+			log.Printf("Unable to hash provided password: %s", err.Error())
+			ctx.String(500, "Unable to hash provided password\n")
+			return
+		}
+
+		defer t.limitIngress(ctx, userid)()
+
+		fileuuid, err := up.store(ctx.Request.Body, ctx.Request.ContentLength, upload{
+			Name:         ctx.Param("filename"),
+			Expiry:       expiry,
+			Password:     password,
+			Owner:        userid,
+			MaxDownloads: downloads,
+			Strip:        strip,
+		})
+		if errors.Is(err, errQuota) {
+			ctx.String(http.StatusRequestEntityTooLarge, "Quota exceeded\n")
+			return
+		}
+		if err != nil {
+			log.Printf("Unable to save uploaded file: %s", err.Error())
+			ctx.String(500, "Unable to save file\n")
+			return
+		}
+
+		id, err := firstLink(db, fileuuid)
+		if err != nil || id == "" {
+			log.Printf("Unable to find link to %s", fileuuid)
+			ctx.String(500, "Unable to find link\n")
+			return
+		}
+
+		ctx.String(http.StatusCreated, link(ctx, c, "/downloads/"+id)+"\n")
+	})
+}
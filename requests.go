@@ -0,0 +1,509 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// The multipart encoding adds some data to an upload besides the file itself.
+const requestOverhead = 64 * 1024
+
+// fileRequest is a link through which anyone can send files to its owner.
+type fileRequest struct {
+	ID       int
+	Token    string
+	Owner    int
+	From     string
+	Name     string
+	Expiry   time.Time
+	MaxSize  sql.NullInt64
+	MaxFiles sql.NullInt64
+	Password sql.NullString
+	Files    int
+
+	// Uploads which have been started but not finished yet. They hold on to
+	// their slot until they are finished or time out.
+	Pending int
+}
+
+func lookupRequest(db *sql.DB, token string) (fileRequest, error) {
+	row := db.QueryRow(`
+		SELECT r.id, r.token, r.owner_id, COALESCE(u.display_name, u.name), r.name, r.expiry, r.max_size, r.max_files, r.password, COUNT(f.uuid) FILTER (WHERE f.done), COUNT(f.uuid) FILTER (WHERE NOT f.done)
+		FROM request r
+		JOIN user u
+		ON r.owner_id = u.id
+		LEFT JOIN file f
+		ON f.request_id = r.id
+		WHERE r.token = ?
+		AND NOT u.disabled
+		GROUP BY r.id
+	`, token)
+
+	var (
+		r      fileRequest
+		expiry int64
+	)
+	if err := row.Scan(&r.ID, &r.Token, &r.Owner, &r.From, &r.Name, &expiry, &r.MaxSize, &r.MaxFiles, &r.Password, &r.Files, &r.Pending); err != nil {
+		return fileRequest{}, err
+	}
+	r.Expiry = time.Unix(expiry, 0)
+
+	return r, nil
+}
+
+func (r fileRequest) Open() bool {
+	return time.Now().Before(r.Expiry)
+}
+
+func (r fileRequest) Full() bool {
+	return r.MaxFiles.Valid && int64(r.Files+r.Pending) >= r.MaxFiles.Int64
+}
+
+func (r fileRequest) limit() int64 {
+	if r.MaxSize.Valid {
+		return r.MaxSize.Int64
+	}
+	return 0
+}
+
+// unlocked reports whether the visitor may upload, which requires the password
+// of the request if it has one.
+func unlocked(session sessions.Session, r fileRequest) bool {
+	if !r.Password.Valid {
+		return true
+	}
+
+	granted, _ := session.Get("requests").([]int)
+	for _, id := range granted {
+		if id == r.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// guestUpload returns the description of a file sent through a request, which
+// expires according to the defaults of the owner.
+func guestUpload(db *sql.DB, r fileRequest, filename string) (upload, error) {
+	p, err := loadPreferences(db, r.Owner)
+	if err != nil {
+		return upload{}, err
+	}
+
+	add, err := asUnit(p.Unit, time.Duration(p.Time))
+	if err != nil {
+		return upload{}, err
+	}
+
+	return upload{
+		Name:   filename,
+		Expiry: time.Now().Add(add),
+		Owner:  r.Owner,
+		Request: sql.NullInt64{
+			Int64: int64(r.ID),
+			Valid: true,
+		},
+	}, nil
+}
+
+// ownUpload reports whether the visitor has prepared the given file and
+// forgets about it once it has been finished.
+func ownUpload(session sessions.Session, fileuuid string, forget bool) bool {
+	uploads, _ := session.Get("uploads").([]string)
+	for i, u := range uploads {
+		if u == fileuuid {
+			if forget {
+				session.Set("uploads", append(uploads[:i:i], uploads[i+1:]...))
+				session.Save()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func registerRequests(router *gin.Engine, priv *gin.RouterGroup, db *sql.DB, c config, up *uploader, t *throttle) {
+	owners := priv.Group("/requests", allow(roleAdmin, roleUser))
+
+	owners.GET("/", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		rows, err := db.Query(`
+			SELECT r.token, r.name, r.expiry, r.max_size, r.max_files, r.password IS NOT NULL, COUNT(f.uuid)
+			FROM request r
+			LEFT JOIN file f
+			ON f.request_id = r.id
+			AND f.done
+			WHERE r.owner_id = ?
+			GROUP BY r.id
+			ORDER BY r.created DESC
+		`, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		defer func() {
+			err := rows.Close()
+			if err != nil {
+				log.Printf("Unable to close rows: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+		}()
+
+		var requests []gin.H
+		for rows.Next() {
+			var (
+				token     string
+				name      string
+				expiry    int64
+				maxSize   sql.NullInt64
+				maxFiles  sql.NullInt64
+				protected bool
+				files     int
+			)
+			if err := rows.Scan(&token, &name, &expiry, &maxSize, &maxFiles, &protected, &files); err != nil {
+				log.Printf("Could not copy values from database: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+
+			request := gin.H{
+				"Token":     token,
+				"Name":      name,
+				"Link":      link(ctx, c, "/requests/"+token),
+				"Expiry":    time.Unix(expiry, 0),
+				"Open":      time.Now().Unix() < expiry,
+				"Protected": protected,
+				"Files":     files,
+			}
+			if maxSize.Valid {
+				request["MaxSize"] = formatSize(maxSize.Int64)
+			}
+			if maxFiles.Valid {
+				request["MaxFiles"] = maxFiles.Int64
+			}
+			requests = append(requests, request)
+		}
+		if err = rows.Err(); err != nil {
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		page(ctx, "requests", gin.H{
+			"Requests": requests,
+		})
+	})
+
+	owners.POST("/", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			Name     string `form:"name" binding:"required"`
+			Time     int64  `form:"time" binding:"required"`
+			Unit     string `form:"unit" binding:"required"`
+			MaxSize  string `form:"max_size"`
+			MaxFiles int64  `form:"max_files"`
+			Password string `form:"password"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/requests/")
+			return
+		}
+
+		add, err := asUnit(in.Unit, time.Duration(in.Time))
+		if err != nil || in.Time < 1 || in.MaxFiles < 0 {
+			ctx.Redirect(http.StatusFound, "/requests/")
+			return
+		}
+
+		var maxSize sql.NullInt64
+		if in.MaxSize != "" {
+			n, err := parseSize(in.MaxSize)
+			if err != nil {
+				ctx.Redirect(http.StatusFound, "/requests/")
+				return
+			}
+			maxSize = sql.NullInt64{
+				Int64: n,
+				Valid: true,
+			}
+		}
+
+		maxFiles := sql.NullInt64{
+			Int64: in.MaxFiles,
+			Valid: in.MaxFiles > 0,
+		}
+
+		password, err := hashPassword(in.Password)
+		if err != nil {
+			log.Printf("Unable to hash provided password: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/requests/")
+			return
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO request (token, owner_id, name, created, expiry, max_size, max_files, password)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, randomString(24), session.Get("user_id"), in.Name, time.Now().Unix(), time.Now().Add(add).Unix(), maxSize, maxFiles, password)
+		if err != nil {
+			log.Printf("Unable to insert request: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/requests/")
+	})
+
+	owners.POST("/:token/close", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		_, err := db.Exec(`
+			UPDATE request
+			SET expiry = ?
+			WHERE token = ?
+			AND owner_id = ?
+			AND expiry > ?
+		`, time.Now().Unix(), ctx.Param("token"), session.Get("user_id"), time.Now().Unix())
+		if err != nil {
+			log.Printf("Unable to close request: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/requests/")
+	})
+
+	// Everything below is meant for anonymous visitors.
+
+	router.GET("/requests/:token", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		r, err := lookupRequest(db, ctx.Param("token"))
+		if err != nil {
+			ctx.HTML(http.StatusNotFound, "request", gin.H{})
+			return
+		}
+
+		h := gin.H{
+			"Request":   r,
+			"Unlocked":  unlocked(session, r),
+			"ChunkSize": c.ChunkSize,
+		}
+		if r.MaxSize.Valid {
+			h["MaxSize"] = formatSize(r.MaxSize.Int64)
+		}
+
+		ctx.HTML(http.StatusOK, "request", h)
+	})
+
+	router.POST("/requests/:token/unlock", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		token := ctx.Param("token")
+
+		r, err := lookupRequest(db, token)
+		if err != nil || !r.Password.Valid {
+			ctx.Redirect(http.StatusFound, "/requests/"+token)
+			return
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(r.Password.String), []byte(ctx.PostForm("password"))) != nil {
+			ctx.Redirect(http.StatusFound, "/requests/"+token)
+			return
+		}
+
+		granted, _ := session.Get("requests").([]int)
+		session.Set("requests", append(granted, r.ID))
+		err = session.Save()
+		if err != nil {
+			log.Printf("Could not save data to session: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		ctx.Redirect(http.StatusFound, "/requests/"+token)
+	})
+
+	// accept looks up the request of the current route and checks whether the
+	// visitor may send another file through it.
+	accept := func(ctx *gin.Context, another bool) (fileRequest, bool) {
+		r, err := lookupRequest(db, ctx.Param("token"))
+		if err != nil {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return fileRequest{}, false
+		}
+
+		if !r.Open() || (another && r.Full()) || !unlocked(sessions.Default(ctx), r) {
+			ctx.AbortWithStatus(http.StatusForbidden)
+			return fileRequest{}, false
+		}
+
+		return r, true
+	}
+
+	router.POST("/requests/:token/upload", func(ctx *gin.Context) {
+		token := ctx.Param("token")
+
+		r, ok := accept(ctx, true)
+		if !ok {
+			return
+		}
+
+		// The body is parsed into temporary files before its size can be
+		// checked, so it has to be cut off early.
+		if r.MaxSize.Valid {
+			ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, r.limit()+requestOverhead)
+		}
+
+		var in struct {
+			File *multipart.FileHeader `form:"file" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormMultipart)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/requests/"+token)
+			return
+		}
+
+		if r.MaxSize.Valid && in.File.Size > r.MaxSize.Int64 {
+			ctx.Redirect(http.StatusFound, "/requests/"+token)
+			return
+		}
+
+		u, err := guestUpload(db, r, in.File.Filename)
+		if err != nil {
+			log.Printf("Unable to prepare upload: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		if _, err := up.save(in.File, u); err != nil {
+			log.Printf("Unable to save uploaded file: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/requests/"+token)
+	})
+
+	router.POST("/requests/:token/prepare", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		r, ok := accept(ctx, true)
+		if !ok {
+			return
+		}
+
+		var in struct {
+			Filename string `json:"filename" binding:"required"`
+			Size     int64  `json:"size"`
+		}
+		err := ctx.ShouldBindJSON(&in)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.JSON(400, gin.H{
+				"error": "Malformed input",
+			})
+			return
+		}
+
+		if r.MaxSize.Valid && in.Size > r.MaxSize.Int64 {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": "File too large",
+			})
+			return
+		}
+
+		u, err := guestUpload(db, r, in.Filename)
+		if err != nil {
+			log.Printf("Unable to prepare upload: %s", err.Error())
+			ctx.JSON(500, gin.H{
+				"error": "Unable to prepare upload",
+			})
+			return
+		}
+
+		fileuuid, err := up.prepare(u)
+		if errors.Is(err, errFull) {
+			ctx.JSON(http.StatusForbidden, gin.H{
+				"error": "Request is full",
+			})
+			return
+		}
+		if err != nil {
+			log.Printf("Unable to insert file: %s", err.Error())
+			ctx.JSON(500, gin.H{
+				"error": "Unable to insert file",
+			})
+			return
+		}
+
+		uploads, _ := session.Get("uploads").([]string)
+		session.Set("uploads", append(uploads, fileuuid))
+		err = session.Save()
+		if err != nil {
+			log.Printf("Could not save data to session: %s", err.Error())
+			ctx.JSON(500, gin.H{
+				"error": "Could not save data to session",
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusCreated, gin.H{
+			"uuid": fileuuid,
+		})
+	})
+
+	router.POST("/requests/:token/append/:uuid", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		r, ok := accept(ctx, false)
+		if !ok {
+			return
+		}
+
+		if !ownUpload(session, ctx.Param("uuid"), false) {
+			appendChunk(ctx, errMetadata)
+			return
+		}
+
+		defer t.limitIngress(ctx, r.Owner)()
+
+		var in struct {
+			Chunk *multipart.FileHeader `form:"chunk" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormMultipart)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": "Malformed input",
+			})
+			return
+		}
+
+		appendChunk(ctx, up.append(ctx.Param("uuid"), r.Owner, in.Chunk, r.limit()))
+	})
+
+	router.POST("/requests/:token/finish/:uuid", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		r, ok := accept(ctx, false)
+		if !ok {
+			return
+		}
+
+		if !ownUpload(session, ctx.Param("uuid"), true) {
+			finishUpload(ctx, errMetadata)
+			return
+		}
+
+		finishUpload(ctx, up.finish(ctx.Param("uuid"), r.Owner))
+	})
+}
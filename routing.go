@@ -5,19 +5,16 @@ import (
 	"embed"
 	"errors"
 	"html/template"
-	"io"
 	"io/fs"
 	"log"
 	"mime/multipart"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
-	"github.com/google/uuid"
-
 	"github.com/gin-contrib/multitemplate"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -32,10 +29,12 @@ var tfsys embed.FS
 //go:embed static/*.css static/*.js
 var sfsys embed.FS
 
-func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string, chunkSize int64, timeout int) {
+func register(router *gin.Engine, db *sql.DB, c config, secret []byte) {
 	// Initialization.
 
-	pending := map[string]*time.Timer{}
+	up := newUploader(db, c)
+	t := newThrottle(c)
+	signKey := deriveKey(secret, "sign")
 
 	renderer := multitemplate.NewRenderer()
 
@@ -43,6 +42,23 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 	renderer.Add("files", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/files.html")))
 	renderer.Add("file", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/file.html")))
 	renderer.Add("unlock", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/unlock.html")))
+	renderer.Add("verify", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/verify.html")))
+	renderer.Add("totp", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/totp.html")))
+	renderer.Add("users", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/users.html")))
+	renderer.Add("everything", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/everything.html")))
+	renderer.Add("confirm", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/confirm.html")))
+	renderer.Add("sessions", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/sessions.html")))
+	renderer.Add("invite", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/invite.html")))
+	renderer.Add("invitations", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/invitations.html")))
+	renderer.Add("request", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/request.html")))
+	renderer.Add("requests", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/requests.html")))
+	renderer.Add("collections", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/collections.html")))
+	renderer.Add("collection", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/collection.html")))
+	renderer.Add("album", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/album.html")))
+	renderer.Add("new-paste", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/new-paste.html")))
+	renderer.Add("paste", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/paste.html")))
+	renderer.Add("preview", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/preview.html")))
+	renderer.Add("settings", template.Must(template.ParseFS(tfsys, "templates/meta.html", "templates/layout.html", "templates/settings.html")))
 
 	router.HTMLRender = renderer
 
@@ -63,52 +79,60 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 			return
 		}
 
-		// Verify that the user exists.
+		// Verify that the user exists and has not been disabled.
 		row := db.QueryRow(`
-			SELECT NULL
+			SELECT role, totp_secret IS NOT NULL OR provider IS 'oidc', COALESCE(display_name, name)
 			FROM user
 			WHERE id = ?
+			AND NOT disabled
 		`, uid)
-		if row.Err() != nil {
+		var (
+			role     string
+			enrolled bool
+			name     string
+		)
+		if err := row.Scan(&role, &enrolled, &name); err != nil {
 			ctx.Redirect(http.StatusFound, "/")
 			ctx.Abort()
 			return
 		}
 
+		// Send users to the enrollment page until they have set up a second factor.
+		// Users of an external identity provider are expected to be covered by it.
+		if c.RequireTOTP && !enrolled && !strings.HasPrefix(ctx.Request.URL.Path, "/totp/") && ctx.Request.URL.Path != "/logout" {
+			ctx.Redirect(http.StatusFound, "/totp/")
+			ctx.Abort()
+			return
+		}
+
+		ctx.Set("role", role)
+		ctx.Set("name", name)
+
 		ctx.Next()
 	})
 
 	// Utility functions.
 
-	asUnit := func(unit string, d time.Duration) (time.Duration, error) {
-		switch unit {
-		case "days":
-			return d * 24 * time.Hour, nil
-		case "hours":
-			return d * time.Hour, nil
-		case "minutes":
-			return d * time.Minute, nil
-		case "seconds":
-			return d * time.Second, nil
-		default:
-			return time.Duration(0), errors.New("invalid unit")
-		}
-	}
+	offer := func(link string, fileuuid string, filename string, ctx *gin.Context) {
+		disposition, mimeType := "attachment", ""
 
-	offer := func(fileuuid string, filename string, ctx *gin.Context) {
-		path := filepath.Join(data, fileuuid)
-		ft, err := filetype.MatchFile(path)
+		ft, err := filetype.MatchFile(filepath.Join(c.Data, fileuuid))
 		if err == nil {
-			for _, it := range inlineTypes {
+			for _, it := range c.InlineTypes {
 				if it == ft.MIME.Value {
-					ctx.Writer.Header().Set("Content-Type", ft.MIME.Value)
-					ctx.File(path)
+					disposition, mimeType = "inline", ft.MIME.Value
 					break
 				}
 			}
 		}
 
-		ctx.FileAttachment(filepath.Join(data, fileuuid), filename)
+		done, ok := t.begin(ctx, fileuuid)
+		if !ok {
+			return
+		}
+		defer done()
+
+		sendFile(ctx, db, c, link, fileuuid, filename, disposition, mimeType)
 	}
 
 	// Routes.
@@ -120,7 +144,9 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 			return
 		}
 
-		ctx.HTML(http.StatusOK, "login", gin.H{})
+		ctx.HTML(http.StatusOK, "login", gin.H{
+			"OIDC": c.OIDC.Issuer != "",
+		})
 	})
 
 	router.POST("/login", func(ctx *gin.Context) {
@@ -135,23 +161,50 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 			return
 		}
 
+		userid, err := authenticate(db, c, in.Name, in.Password)
+		if err != nil {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
 		row := db.QueryRow(`
-			SELECT id, password
+			SELECT totp_secret IS NOT NULL, disabled
 			FROM user
-			WHERE name = ?
-		`, in.Name)
+			WHERE id = ?
+		`, userid)
 
 		var (
-			userid   int
-			password string
+			enrolled bool
+			disabled bool
 		)
-		err = row.Scan(&userid, &password)
-		if err != nil || bcrypt.CompareHashAndPassword([]byte(password), []byte(in.Password)) != nil {
+		if err := row.Scan(&enrolled, &disabled); err != nil {
+			log.Printf("Could not copy values from database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		if disabled {
+			log.Printf("Disabled user %s attempted to log in", in.Name)
 			ctx.Redirect(http.StatusFound, "/")
 			return
 		}
 
 		session := sessions.Default(ctx)
+
+		// Ask for the second factor before the session is authenticated.
+		if enrolled {
+			session.Set("pending_user_id", userid)
+			err = session.Save()
+			if err != nil {
+				log.Printf("Could not save data to session: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+
+			ctx.Redirect(http.StatusFound, "/login/totp")
+			return
+		}
+
 		session.Set("user_id", userid)
 		err = session.Save()
 		if err != nil {
@@ -163,6 +216,25 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 		ctx.Redirect(http.StatusFound, "/files/")
 	})
 
+	registerTOTP(router, priv, db, c, deriveKey(secret, "totp"))
+	registerOIDC(router, db, c.OIDC)
+	registerAdmin(priv, db, c, t)
+	registerSettings(priv, db)
+	registerInvitations(router, priv, db, c)
+	registerRequests(router, priv, db, c, up, t)
+	registerShares(priv, db)
+	registerLinks(priv, db)
+	registerCollections(router, priv, db, c, offer, t)
+	registerZip(priv, db, c, t)
+	registerBundles(priv, db, up)
+	registerPut(router, db, c, up, t)
+	registerPastes(router, priv, db, c, up)
+	registerPreviews(router, db, c, t)
+	registerArchives(router, db, c, t)
+	registerThumbnails(priv, db, c)
+	registerMetrics(router, c, t)
+	registerSigning(router, db, c, signKey)
+
 	priv.POST("/logout", func(ctx *gin.Context) {
 		session := sessions.Default(ctx)
 		session.Clear()
@@ -171,14 +243,119 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 		ctx.Redirect(http.StatusFound, "/")
 	})
 
+	priv.GET("/sessions/", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		rows, err := db.Query(`
+			SELECT id, token, created, accessed, address, agent
+			FROM session
+			WHERE user_id = ?
+			ORDER BY accessed DESC
+		`, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		defer func() {
+			err := rows.Close()
+			if err != nil {
+				log.Printf("Unable to close rows: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+		}()
+
+		current := hashToken(session.ID())
+
+		var list []gin.H
+		for rows.Next() {
+			var (
+				id       int
+				token    string
+				created  int64
+				accessed int64
+				address  string
+				agent    string
+			)
+			if err := rows.Scan(&id, &token, &created, &accessed, &address, &agent); err != nil {
+				log.Printf("Could not copy values from database: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+			list = append(list, gin.H{
+				"ID":       id,
+				"Created":  time.Unix(created, 0),
+				"Accessed": time.Unix(accessed, 0),
+				"Address":  address,
+				"Agent":    agent,
+				"Current":  token == current,
+			})
+		}
+		if err = rows.Err(); err != nil {
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		page(ctx, "sessions", gin.H{
+			"Sessions": list,
+		})
+	})
+
+	priv.POST("/sessions/revoke", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			ID int `form:"id" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/sessions/")
+			return
+		}
+
+		_, err = db.Exec(`
+			DELETE FROM session
+			WHERE id = ?
+			AND user_id = ?
+		`, in.ID, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to delete session: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/sessions/")
+	})
+
+	priv.POST("/sessions/clear", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		_, err := db.Exec(`
+			DELETE FROM session
+			WHERE user_id = ?
+		`, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to delete sessions: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		session.Clear()
+		session.Save()
+
+		ctx.Redirect(http.StatusFound, "/")
+	})
+
 	priv.GET("/files/", func(ctx *gin.Context) {
 		session := sessions.Default(ctx)
 
 		rows, err := db.Query(`
-			SELECT uuid, name
-			FROM file
-			WHERE owner_id = ?
-			AND done
+			SELECT f.uuid, f.name, r.name
+			FROM file f
+			LEFT JOIN request r
+			ON f.request_id = r.id
+			WHERE f.owner_id = ?
+			AND f.done
 		`, session.Get("user_id"))
 
 		if err != nil {
@@ -200,15 +377,18 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 			var (
 				fileuuid string
 				filename string
+				request  sql.NullString
 			)
-			if err := rows.Scan(&fileuuid, &filename); err != nil {
+			if err := rows.Scan(&fileuuid, &filename, &request); err != nil {
 				log.Printf("Could not copy values from database: %s", err.Error())
 				ctx.AbortWithStatus(500)
 				return
 			}
 			files = append(files, gin.H{
-				"UUID": fileuuid,
-				"Name": filename,
+				"UUID":      fileuuid,
+				"Name":      filename,
+				"Request":   request.String,
+				"Thumbnail": hasThumbnail(c.Data, fileuuid),
 			})
 		}
 		if err = rows.Err(); err != nil {
@@ -216,19 +396,42 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 			return
 		}
 
-		ctx.HTML(http.StatusOK, "files", gin.H{
-			"Files":     files,
-			"ChunkSize": chunkSize,
+		shared, err := sharedWith(db, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		for _, file := range shared {
+			file["Thumbnail"] = hasThumbnail(c.Data, file["UUID"].(string))
+		}
+
+		p, err := loadPreferences(db, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Could not copy values from database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		page(ctx, "files", gin.H{
+			"Files":       files,
+			"Shared":      shared,
+			"ChunkSize":   c.ChunkSize,
+			"Upload":      ctx.GetString("role") != roleReader,
+			"Preferences": p,
+			"Grid":        ctx.Query("view") == "grid",
+			"Strip":       c.StripMetadata,
 		})
 	})
 
-	priv.POST("/upload", func(ctx *gin.Context) {
+	priv.POST("/upload", allow(roleAdmin, roleUser, roleUploader), func(ctx *gin.Context) {
 		session := sessions.Default(ctx)
 
 		var in struct {
 			Password string                `form:"password"`
 			Time     int64                 `form:"time" binding:"required"`
 			Unit     string                `form:"unit" binding:"required"`
+			Strip    *bool                 `form:"strip"`
 			File     *multipart.FileHeader `form:"file" binding:"required"`
 		}
 		err := ctx.ShouldBindWith(&in, binding.FormMultipart)
@@ -254,46 +457,33 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 			return
 		}
 
-		fileuuid := uuid.New().String()
-
-		if err := ctx.SaveUploadedFile(in.File, filepath.Join(data, fileuuid)); err != nil {
-			log.Printf("Unable to save uploaded file: %s", err.Error())
+		if err := checkPolicy(db, session.Get("user_id"), in.Password); err != nil {
 			ctx.Redirect(http.StatusFound, "/files/")
 			return
 		}
 
-		var password sql.NullString
-		if len(in.Password) == 0 {
-			password = sql.NullString{}
-		} else {
-			hash, err := bcrypt.GenerateFromPassword([]byte(in.Password), 12)
-			if err != nil {
-				log.Printf("Unable to hash provided password: %s", err.Error())
-				ctx.Redirect(http.StatusFound, "/files/")
-				return
-			}
-			password = sql.NullString{
-				String: string(hash),
-				Valid:  true,
-			}
-		}
-
-		_, err = db.Exec(`
-			INSERT INTO file (uuid, name, expiry, password, done, owner_id)
-			VALUES (?, ?, ?, ?, 1, ?)
-		`, fileuuid, in.File.Filename, expiry.Unix(), password, session.Get("user_id"))
+		password, err := hashPassword(in.Password)
 		if err != nil {
-			log.Printf("Unable to insert file: %s", err.Error())
+			log.Printf("Unable to hash provided password: %s", err.Error())
 			ctx.Redirect(http.StatusFound, "/files/")
 			return
 		}
 
-		watch(fileuuid, expiry, data, db)
+		_, err = up.save(in.File, upload{
+			Name:     in.File.Filename,
+			Expiry:   expiry,
+			Password: password,
+			Owner:    session.Get("user_id"),
+			Strip:    nullBool(in.Strip),
+		})
+		if err != nil {
+			log.Printf("Unable to save uploaded file: %s", err.Error())
+		}
 
 		ctx.Redirect(http.StatusFound, "/files/")
 	})
 
-	priv.POST("/prepare", func(ctx *gin.Context) {
+	priv.POST("/prepare", allow(roleAdmin, roleUser, roleUploader), func(ctx *gin.Context) {
 		session := sessions.Default(ctx)
 
 		var in struct {
@@ -301,6 +491,7 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 			Time     int64  `json:"time" binding:"required"`
 			Unit     string `json:"unit" binding:"required"`
 			Filename string `json:"filename" binding:"required"`
+			Strip    *bool  `json:"strip"`
 		}
 		err := ctx.ShouldBindJSON(&in)
 		if err != nil {
@@ -331,30 +522,29 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 			return
 		}
 
-		fileuuid := uuid.New().String()
+		if err := checkPolicy(db, session.Get("user_id"), in.Password); err != nil {
+			ctx.JSON(400, gin.H{
+				"error": "Password required",
+			})
+			return
+		}
 
-		var password sql.NullString
-		if len(in.Password) == 0 {
-			password = sql.NullString{}
-		} else {
-			hash, err := bcrypt.GenerateFromPassword([]byte(in.Password), 12)
-			if err != nil {
-				log.Printf("Unable to hash provided password: %s", err.Error())
-				ctx.JSON(500, gin.H{
-					"error": "Unable to hash provided password",
-				})
-				return
-			}
-			password = sql.NullString{
-				String: string(hash),
-				Valid:  true,
-			}
+		password, err := hashPassword(in.Password)
+		if err != nil {
+			log.Printf("Unable to hash provided password: %s", err.Error())
+			ctx.JSON(500, gin.H{
+				"error": "Unable to hash provided password",
+			})
+			return
 		}
 
-		_, err = db.Exec(`
-			INSERT INTO file (uuid, name, expiry, password, done, owner_id)
-			VALUES (?, ?, ?, ?, 0, ?)
-		`, fileuuid, in.Filename, expiry.Unix(), password, session.Get("user_id"))
+		fileuuid, err := up.prepare(upload{
+			Name:     in.Filename,
+			Expiry:   expiry,
+			Password: password,
+			Owner:    session.Get("user_id"),
+			Strip:    nullBool(in.Strip),
+		})
 		if err != nil {
 			log.Printf("Unable to insert file: %s", err.Error())
 			ctx.JSON(500, gin.H{
@@ -366,17 +556,13 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 		ctx.JSON(http.StatusCreated, gin.H{
 			"uuid": fileuuid,
 		})
-
-		pending[fileuuid] = time.AfterFunc(time.Duration(time.Second*time.Duration(timeout)), func() {
-			log.Printf("File %s timed out", fileuuid)
-			remove(fileuuid, data, db)
-			delete(pending, fileuuid)
-		})
 	})
 
-	priv.POST("/append/:uuid", func(ctx *gin.Context) {
+	priv.POST("/append/:uuid", allow(roleAdmin, roleUser, roleUploader), func(ctx *gin.Context) {
 		session := sessions.Default(ctx)
 
+		defer t.limitIngress(ctx, session.Get("user_id"))()
+
 		var in struct {
 			Chunk *multipart.FileHeader `form:"chunk" binding:"required"`
 		}
@@ -388,169 +574,94 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 			return
 		}
 
-		if in.Chunk.Size > chunkSize {
-			ctx.JSON(400, gin.H{
-				"error": "Chunk too large",
-			})
-			return
-		}
+		appendChunk(ctx, up.append(ctx.Param("uuid"), session.Get("user_id"), in.Chunk, 0))
+	})
 
-		fileuuid := ctx.Param("uuid")
+	priv.POST("/finish/:uuid", allow(roleAdmin, roleUser, roleUploader), func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
 
-		row := db.QueryRow(`
-			SELECT NULL
-			FROM file
-			WHERE uuid = ?
-			AND owner_id = ?
-			AND NOT done
-		`, fileuuid, session.Get("user_id"))
-		if row.Err() != nil {
-			ctx.JSON(400, gin.H{
-				"error": "Metadata does not match",
-			})
-			return
-		}
+		finishUpload(ctx, up.finish(ctx.Param("uuid"), session.Get("user_id")))
+	})
 
-		pending[fileuuid].Stop()
-		defer pending[fileuuid].Reset(time.Second * time.Duration(timeout))
+	priv.GET("/files/:uuid", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
 
-		chunk, err := in.Chunk.Open()
-		if err != nil {
-			log.Printf("Unable to open chunk: %s", err.Error())
-			ctx.JSON(500, gin.H{
-				"error": "Unable to read chunk from form data",
-			})
+		permission, err := access(db, ctx.Param("uuid"), session.Get("user_id"))
+		if err != nil || permission == "" {
+			ctx.Redirect(http.StatusFound, "/files/")
 			return
 		}
-		defer func() {
-			err = chunk.Close()
-			if err != nil {
-				log.Printf("Unable to close chunk file: %s", err.Error())
-				ctx.JSON(500, gin.H{
-					"error": "Unable to close chunk",
-				})
-				return
-			}
-		}()
 
-		file, err := os.OpenFile(filepath.Join(data, ctx.Param("uuid")), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Printf("Unable to open destination file: %s", err.Error())
-			ctx.JSON(500, gin.H{
-				"error": "Unable to open file",
-			})
-			return
-		}
-		defer func() {
-			err = file.Close()
-			if err != nil {
-				log.Printf("Unable to close destination file: %s", err.Error())
-				ctx.JSON(500, gin.H{
-					"error": "Unable to close file",
-				})
-				return
-			}
-		}()
+		row := db.QueryRow(`
+			SELECT f.uuid, f.name, f.expiry, u.name, f.downloads, f.max_downloads, f.stripped
+			FROM file f
+			JOIN user u
+			ON f.owner_id = u.id
+			WHERE f.uuid = ?
+		`, ctx.Param("uuid"))
 
-		// Append to the file identified by the UUID.
-		_, err = io.Copy(file, chunk)
-		if err != nil {
-			log.Printf("Unable to append chunk to destination file: %s", err.Error())
-			ctx.JSON(500, gin.H{
-				"error": "Unable to append chunk",
-			})
+		var (
+			fileuuid     string
+			filename     string
+			expiry       int64
+			owner        string
+			downloads    int64
+			maxDownloads sql.NullInt64
+			stripped     bool
+		)
+		if err := row.Scan(&fileuuid, &filename, &expiry, &owner, &downloads, &maxDownloads, &stripped); err != nil {
+			log.Printf("Could not copy values from database: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/files/")
 			return
 		}
-	})
-
-	priv.POST("/finish/:uuid", func(ctx *gin.Context) {
-		session := sessions.Default(ctx)
-
-		fileuuid := ctx.Param("uuid")
 
-		row := db.QueryRow(`
-			SELECT NULL
-			FROM file
-			WHERE uuid = ?
-			AND owner_id = ?
-			AND NOT done
-		`, fileuuid, session.Get("user_id"))
-		if row.Err() != nil {
-			ctx.JSON(400, gin.H{
-				"error": "Metadata does not match",
-			})
-			return
+		h := gin.H{
+			"File": gin.H{
+				"UUID":     fileuuid,
+				"Name":     filename,
+				"Expiry":   time.Unix(expiry, 0),
+				"Owner":    owner,
+				"Stripped": stripped,
+			},
+			"Downloads":  downloads,
+			"Permission": permission,
+			"Manage":     canManage(permission),
 		}
 
-		pending[fileuuid].Stop()
-		delete(pending, fileuuid)
+		if maxDownloads.Valid {
+			h["MaxDownloads"] = maxDownloads.Int64
+		}
 
-		_, err := db.Exec(`
-			UPDATE file
-			SET done = 1
-			WHERE uuid = ?
-		`, ctx.Param("uuid"))
+		name, err := firstLink(db, fileuuid)
 		if err != nil {
-			log.Printf("Unable to mark file as done: %s", err.Error())
-			ctx.JSON(500, gin.H{
-				"error": "Could not mark file as done",
-			})
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
 			return
 		}
-
-		row = db.QueryRow(`
-			SELECT expiry
-			FROM file
-			WHERE uuid = ?
-			AND owner_id = ?
-		`, ctx.Param("uuid"), session.Get("user_id"))
-
-		var expiry int64
-		if err := row.Scan(&expiry); err != nil {
-			log.Printf("Could not get expiry from database: %s", err.Error())
-			ctx.JSON(500, gin.H{
-				"error": "Could not get expiry from database",
-			})
-			return
+		if name != "" {
+			h["Link"] = link(ctx, c, "/downloads/"+name)
 		}
 
-		watch(ctx.Param("uuid"), time.Unix(expiry, 0), data, db)
-
-		ctx.JSON(http.StatusOK, gin.H{})
-	})
-
-	priv.GET("/files/:uuid", func(ctx *gin.Context) {
-		session := sessions.Default(ctx)
-
-		row := db.QueryRow(`
-			SELECT uuid, name, expiry
-			FROM file
-			WHERE uuid = ?
-			AND owner_id = ?
-			AND done
-		`, ctx.Param("uuid"), session.Get("user_id"))
+		if canManage(permission) {
+			h["Shares"], err = shares(db, fileuuid)
+			if err != nil {
+				log.Printf("Could not query database: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
 
-		var (
-			fileuuid string
-			filename string
-			expiry   int64
-		)
-		if err := row.Scan(&fileuuid, &filename, &expiry); err != nil {
-			log.Printf("Could not copy values from database: %s", err.Error())
-			ctx.Redirect(http.StatusFound, "/files/")
-			return
+			h["Links"], err = links(ctx, db, c, fileuuid)
+			if err != nil {
+				log.Printf("Could not query database: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
 		}
 
-		ctx.HTML(http.StatusOK, "file", gin.H{
-			"File": gin.H{
-				"UUID":   fileuuid,
-				"Name":   filename,
-				"Expiry": time.Unix(expiry, 0),
-			},
-		})
+		page(ctx, "file", h)
 	})
 
-	priv.POST("/revise", func(ctx *gin.Context) {
+	priv.POST("/revise", allow(roleAdmin, roleUser), func(ctx *gin.Context) {
 		session := sessions.Default(ctx)
 
 		var in struct {
@@ -564,13 +675,18 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 			return
 		}
 
+		permission, err := access(db, in.UUID, session.Get("user_id"))
+		if err != nil || !canManage(permission) {
+			ctx.Redirect(http.StatusFound, "/files/")
+			return
+		}
+
 		_, err = db.Exec(`
 			UPDATE file
 			SET
 				name = ?
 			WHERE uuid = ?
-			AND owner_id = ?
-		`, in.Filename, in.UUID, session.Get("user_id"))
+		`, in.Filename, in.UUID)
 		if err != nil {
 			log.Printf("Unable to update file: %s", err.Error())
 		}
@@ -578,69 +694,205 @@ func register(router *gin.Engine, db *sql.DB, data string, inlineTypes []string,
 		ctx.Redirect(http.StatusFound, "/files/")
 	})
 
-	router.GET("/downloads/:uuid", func(ctx *gin.Context) {
+	// Files are downloaded through their links, so that their UUID is only
+	// known to those who may manage them.
+	download := func(ctx *gin.Context) {
+		id := ctx.Param("id")
+
+		l, err := lookupLink(db, id)
+		if err != nil {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+		fileuuid := l.File
+
 		row := db.QueryRow(`
-			SELECT f.uuid, f.name, f.password, u.id
-			FROM file f
-			JOIN user u
-			ON f.owner_id = u.id
-			WHERE f.uuid = ?
+			SELECT name, password, language, expiry, size, max_downloads IS NOT NULL
+			FROM file
+			WHERE uuid = ?
 			AND done
-		`, ctx.Param("uuid"))
+		`, fileuuid)
 
 		var (
-			fileuuid string
 			filename string
 			password sql.NullString
-			owner    int
+			language sql.NullString
+			expiry   int64
+			size     int64
+			limited  bool
 		)
-		if err := row.Scan(&fileuuid, &filename, &password, &owner); err != nil {
+		if err := row.Scan(&filename, &password, &language, &expiry, &size, &limited); err != nil {
 			log.Printf("Could not copy values from database: %s", err.Error())
 			ctx.Redirect(http.StatusFound, "/")
 			return
 		}
+		// The password of a link replaces the one of the file.
+		if l.Password.Valid {
+			password = l.Password
+		}
+		limited = limited || l.MaxDownloads.Valid
+		if l.Expiry.Valid && l.Expiry.Int64 < expiry {
+			expiry = l.Expiry.Int64
+		}
 
+		// Signed URLs are meant for scripts, so they skip the password as well as
+		// the preview and go straight to the download.
+		if ctx.Query("signature") != "" {
+			if !validSignature(ctx, signKey, l) {
+				ctx.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			offer(id, fileuuid, filename, ctx)
+			return
+		}
+
+		// Users the file has been shared with do not need the password.
 		session := sessions.Default(ctx)
-		if session.Get("user_id") != owner && password.Valid {
+		permission, err := access(db, fileuuid, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to check access: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		if permission == "" && password.Valid && !linkUnlocked(session, id) {
 			ctx.HTML(http.StatusOK, "unlock", gin.H{
 				"File": gin.H{
-					"UUID": fileuuid,
+					"ID":   id,
 					"Name": filename,
 				},
 			})
-		} else {
-			offer(fileuuid, filename, ctx)
+			return
 		}
-	})
 
-	router.POST("/downloads/:uuid", func(ctx *gin.Context) {
+		if language.Valid {
+			showPaste(ctx, db, c, id, fileuuid, filename, language.String)
+			return
+		}
+
+		// Previewing would use up files which can only be downloaded a few times.
+		if c.Previews && !limited {
+			showPreview(ctx, c, id, fileuuid, filename, time.Unix(expiry, 0), size)
+			return
+		}
+
+		offer(id, fileuuid, filename, ctx)
+	}
+
+	router.GET("/downloads/:id", download)
+	router.HEAD("/downloads/:id", download)
+
+	router.POST("/downloads/:id", func(ctx *gin.Context) {
 		fpassword := ctx.PostForm("password")
 
+		id := ctx.Param("id")
+
+		l, err := lookupLink(db, id)
+		if err != nil {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+		fileuuid := l.File
+
 		row := db.QueryRow(`
-			SELECT f.uuid, f.name, f.password, u.id, u.name
-			FROM file f
-			JOIN user u
-			ON f.owner_id = u.id
-			WHERE f.uuid = ?
+			SELECT password
+			FROM file
+			WHERE uuid = ?
 			AND done
-		`, ctx.Param("uuid"))
+		`, fileuuid)
 
-		var fileuuid string
-		var filename string
 		var password sql.NullString
-		var owner int
-		if err := row.Scan(&fileuuid, &filename, &password, &owner); err != nil {
+		if err := row.Scan(&password); err != nil {
 			log.Printf("Could not copy values from database: %s", err.Error())
 			ctx.Redirect(http.StatusFound, "/")
 			return
 		}
+		// The password of a link replaces the one of the file.
+		if l.Password.Valid {
+			password = l.Password
+		}
 
-		session := sessions.Default(ctx)
-		if session.Get("user_id") != owner && password.Valid && bcrypt.CompareHashAndPassword([]byte(password.String), []byte(fpassword)) != nil {
+		if password.Valid && bcrypt.CompareHashAndPassword([]byte(password.String), []byte(fpassword)) != nil {
 			ctx.Redirect(http.StatusFound, "/")
 			return
 		}
 
-		offer(fileuuid, filename, ctx)
+		// The password is remembered, so that the file can be viewed and
+		// downloaded through the link without entering it again.
+		if err := unlockLink(sessions.Default(ctx), id); err != nil {
+			log.Printf("Could not save data to session: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		ctx.Redirect(http.StatusFound, "/downloads/"+id)
 	})
 }
+
+// page renders a template based on the layout, which needs to know about the
+// role and name of the current user.
+func page(ctx *gin.Context, name string, h gin.H) {
+	h["Role"] = ctx.GetString("role")
+	h["DisplayName"] = ctx.GetString("name")
+	ctx.HTML(http.StatusOK, name, h)
+}
+
+// link turns a path into an absolute URL, preferring the configured public URL
+// over the host the request was made to.
+func link(ctx *gin.Context, c config, path string) string {
+	if c.URL != "" {
+		return strings.TrimSuffix(c.URL, "/") + path
+	}
+
+	scheme := "http"
+	if ctx.Request.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + ctx.Request.Host + path
+}
+
+// appendChunk and finishUpload answer the requests of the chunked upload.
+func appendChunk(ctx *gin.Context, err error) {
+	switch {
+	case err == nil:
+		ctx.JSON(http.StatusOK, gin.H{})
+	case errors.Is(err, errMetadata):
+		ctx.JSON(400, gin.H{
+			"error": "Metadata does not match",
+		})
+	case errors.Is(err, errChunk):
+		ctx.JSON(400, gin.H{
+			"error": "Chunk too large",
+		})
+	case errors.Is(err, errTooLarge):
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": "File too large",
+		})
+	case errors.Is(err, errQuota):
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": "Quota exceeded",
+		})
+	default:
+		log.Printf("Unable to append chunk to destination file: %s", err.Error())
+		ctx.JSON(500, gin.H{
+			"error": "Unable to append chunk",
+		})
+	}
+}
+
+func finishUpload(ctx *gin.Context, err error) {
+	switch {
+	case err == nil:
+		ctx.JSON(http.StatusOK, gin.H{})
+	case errors.Is(err, errMetadata):
+		ctx.JSON(400, gin.H{
+			"error": "Metadata does not match",
+		})
+	default:
+		log.Printf("Unable to mark file as done: %s", err.Error())
+		ctx.JSON(500, gin.H{
+			"error": "Could not mark file as done",
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	policyOptional = "optional"
+	policyRequired = "required"
+)
+
+type preferences struct {
+	DisplayName    string
+	Email          string
+	Time           int64
+	Unit           string
+	PasswordPolicy string
+}
+
+func loadPreferences(db *sql.DB, userid interface{}) (preferences, error) {
+	row := db.QueryRow(`
+		SELECT display_name, email, expiry_time, expiry_unit, password_policy
+		FROM user
+		WHERE id = ?
+	`, userid)
+
+	var (
+		p           preferences
+		displayName sql.NullString
+		email       sql.NullString
+	)
+	if err := row.Scan(&displayName, &email, &p.Time, &p.Unit, &p.PasswordPolicy); err != nil {
+		return preferences{}, err
+	}
+	p.DisplayName = displayName.String
+	p.Email = email.String
+
+	return p, nil
+}
+
+// checkPolicy enforces the password policy a user has chosen for their own
+// uploads.
+func checkPolicy(db *sql.DB, userid interface{}, password string) error {
+	p, err := loadPreferences(db, userid)
+	if err != nil {
+		return err
+	}
+
+	if p.PasswordPolicy == policyRequired && password == "" {
+		return errors.New("a password is required")
+	}
+
+	return nil
+}
+
+func registerSettings(priv *gin.RouterGroup, db *sql.DB) {
+	show := func(ctx *gin.Context, h gin.H) {
+		session := sessions.Default(ctx)
+
+		p, err := loadPreferences(db, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Could not copy values from database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		row := db.QueryRow(`
+			SELECT name, provider IS NULL
+			FROM user
+			WHERE id = ?
+		`, session.Get("user_id"))
+
+		var (
+			name  string
+			local bool
+		)
+		if err := row.Scan(&name, &local); err != nil {
+			log.Printf("Could not copy values from database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		list, err := tokens(db, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		h["Name"] = name
+		h["Local"] = local
+		h["Preferences"] = p
+		h["Changed"] = ctx.Query("changed") != ""
+		h["Tokens"] = list
+		page(ctx, "settings", h)
+	}
+
+	priv.GET("/settings/", func(ctx *gin.Context) {
+		show(ctx, gin.H{})
+	})
+
+	priv.POST("/settings/password", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			Current      string `form:"current" binding:"required"`
+			Password     string `form:"password" binding:"required"`
+			Confirmation string `form:"confirmation" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		if in.Password != in.Confirmation {
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		row := db.QueryRow(`
+			SELECT password
+			FROM user
+			WHERE id = ?
+			AND provider IS NULL
+		`, session.Get("user_id"))
+
+		var password string
+		if err := row.Scan(&password); err != nil {
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(password), []byte(in.Current)) != nil {
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(in.Password), 12)
+		if err != nil {
+			log.Printf("Unable to hash provided password: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		_, err = db.Exec(`
+			UPDATE user
+			SET password = ?
+			WHERE id = ?
+		`, hash, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to update password: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		// Everyone who knew the old password is signed out, except for this session.
+		_, err = db.Exec(`
+			DELETE FROM session
+			WHERE user_id = ?
+			AND token != ?
+		`, session.Get("user_id"), hashToken(session.ID()))
+		if err != nil {
+			log.Printf("Unable to delete sessions: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/settings/?changed=1")
+	})
+
+	priv.POST("/settings/profile", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			DisplayName string `form:"display_name"`
+			Email       string `form:"email"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		var email sql.NullString
+		if in.Email != "" {
+			address, err := mail.ParseAddress(in.Email)
+			if err != nil {
+				ctx.Redirect(http.StatusFound, "/settings/")
+				return
+			}
+			email = sql.NullString{
+				String: address.Address,
+				Valid:  true,
+			}
+		}
+
+		displayName := sql.NullString{
+			String: in.DisplayName,
+			Valid:  in.DisplayName != "",
+		}
+
+		_, err = db.Exec(`
+			UPDATE user
+			SET
+				display_name = ?,
+				email = ?
+			WHERE id = ?
+		`, displayName, email, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to update profile: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/settings/")
+	})
+
+	priv.POST("/settings/defaults", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			Time           int64  `form:"time" binding:"required"`
+			Unit           string `form:"unit" binding:"required"`
+			PasswordPolicy string `form:"password_policy" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		// The default has to be something that uploads would accept.
+		add, err := asUnit(in.Unit, time.Duration(in.Time))
+		if err != nil || in.Time < 1 || add > time.Duration(24*365)*time.Hour {
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		if in.PasswordPolicy != policyOptional && in.PasswordPolicy != policyRequired {
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		_, err = db.Exec(`
+			UPDATE user
+			SET
+				expiry_time = ?,
+				expiry_unit = ?,
+				password_policy = ?
+			WHERE id = ?
+		`, in.Time, in.Unit, in.PasswordPolicy, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to update defaults: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/settings/")
+	})
+
+	priv.POST("/settings/tokens", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			Name string `form:"name" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		token, err := createToken(db, session.Get("user_id"), in.Name)
+		if err != nil {
+			log.Printf("Unable to create token: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		// The token is only shown once, right after it has been created.
+		show(ctx, gin.H{
+			"Token": token,
+		})
+	})
+
+	priv.POST("/settings/tokens/revoke", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		id, err := strconv.Atoi(ctx.PostForm("id"))
+		if err != nil {
+			ctx.Redirect(http.StatusFound, "/settings/")
+			return
+		}
+
+		_, err = db.Exec(`
+			DELETE FROM api_token
+			WHERE id = ?
+			AND user_id = ?
+		`, id, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to revoke token: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/settings/")
+	})
+}
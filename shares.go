@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Permissions on a file in order of decreasing privilege. Only the owner can
+// delete a file, while manage allows renaming and sharing it.
+const (
+	permOwner  = "owner"
+	permManage = "manage"
+	permRead   = "read"
+)
+
+// access returns the permission a user has on a finished file, or an empty
+// string if they have none.
+func access(db *sql.DB, fileuuid string, userid interface{}) (string, error) {
+	if userid == nil {
+		return "", nil
+	}
+
+	row := db.QueryRow(`
+		SELECT CASE WHEN f.owner_id = ? THEN 'owner' ELSE s.permission END
+		FROM file f
+		LEFT JOIN share s
+		ON s.file_uuid = f.uuid
+		AND s.user_id = ?
+		WHERE f.uuid = ?
+		AND f.done
+	`, userid, userid, fileuuid)
+
+	var permission sql.NullString
+	if err := row.Scan(&permission); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return permission.String, nil
+}
+
+func canManage(permission string) bool {
+	return permission == permOwner || permission == permManage
+}
+
+// unlockLink remembers that the visitor has entered the password of a link.
+func unlockLink(session sessions.Session, name string) error {
+	unlocked, _ := session.Get("links").([]string)
+	session.Set("links", append(unlocked, name))
+	return session.Save()
+}
+
+func linkUnlocked(session sessions.Session, name string) bool {
+	unlocked, _ := session.Get("links").([]string)
+	for _, u := range unlocked {
+		if u == name {
+			return true
+		}
+	}
+	return false
+}
+
+// manageable checks that the current user may manage the file of the route.
+func manageable(ctx *gin.Context, db *sql.DB) (string, bool) {
+	fileuuid := ctx.Param("uuid")
+
+	permission, err := access(db, fileuuid, sessions.Default(ctx).Get("user_id"))
+	if err != nil {
+		log.Printf("Unable to check access: %s", err.Error())
+		ctx.AbortWithStatus(500)
+		return "", false
+	}
+
+	if !canManage(permission) {
+		ctx.Redirect(http.StatusFound, "/files/")
+		return "", false
+	}
+
+	return fileuuid, true
+}
+
+func registerShares(priv *gin.RouterGroup, db *sql.DB) {
+	priv.POST("/files/:uuid/share", allow(roleAdmin, roleUser), func(ctx *gin.Context) {
+		fileuuid, ok := manageable(ctx, db)
+		if !ok {
+			return
+		}
+
+		var in struct {
+			Name       string `form:"name" binding:"required"`
+			Permission string `form:"permission" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil || (in.Permission != permRead && in.Permission != permManage) {
+			ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+			return
+		}
+
+		userid, err := lookupUser(db, in.Name)
+		if err != nil {
+			log.Printf("Unable to share file with %s: %s", in.Name, err.Error())
+			ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+			return
+		}
+
+		// The owner already has full access.
+		_, err = db.Exec(`
+			INSERT INTO share (file_uuid, user_id, permission)
+			SELECT uuid, ?, ?
+			FROM file
+			WHERE uuid = ?
+			AND owner_id != ?
+			ON CONFLICT (file_uuid, user_id) DO UPDATE SET permission = excluded.permission
+		`, userid, in.Permission, fileuuid, userid)
+		if err != nil {
+			log.Printf("Unable to share file: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+	})
+
+	priv.POST("/files/:uuid/unshare", allow(roleAdmin, roleUser), func(ctx *gin.Context) {
+		fileuuid, ok := manageable(ctx, db)
+		if !ok {
+			return
+		}
+
+		userid, err := strconv.Atoi(ctx.PostForm("id"))
+		if err != nil {
+			ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+			return
+		}
+
+		_, err = db.Exec(`
+			DELETE FROM share
+			WHERE file_uuid = ?
+			AND user_id = ?
+		`, fileuuid, userid)
+		if err != nil {
+			log.Printf("Unable to unshare file: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/files/"+fileuuid)
+	})
+}
+
+// shares lists the users a file has been shared with.
+func shares(db *sql.DB, fileuuid string) ([]gin.H, error) {
+	rows, err := db.Query(`
+		SELECT u.id, u.name, s.permission
+		FROM share s
+		JOIN user u
+		ON s.user_id = u.id
+		WHERE s.file_uuid = ?
+		ORDER BY u.name
+	`, fileuuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []gin.H
+	for rows.Next() {
+		var (
+			id         int
+			name       string
+			permission string
+		)
+		if err := rows.Scan(&id, &name, &permission); err != nil {
+			return nil, fmt.Errorf("could not copy values from database: %w", err)
+		}
+		list = append(list, gin.H{
+			"ID":         id,
+			"Name":       name,
+			"Permission": permission,
+		})
+	}
+
+	return list, rows.Err()
+}
+
+// sharedWith lists the files other users have shared with a user.
+func sharedWith(db *sql.DB, userid interface{}) ([]gin.H, error) {
+	rows, err := db.Query(`
+		SELECT f.uuid, f.name, u.name, s.permission
+		FROM share s
+		JOIN file f
+		ON s.file_uuid = f.uuid
+		JOIN user u
+		ON f.owner_id = u.id
+		WHERE s.user_id = ?
+		AND f.done
+		ORDER BY f.name
+	`, userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []gin.H
+	for rows.Next() {
+		var (
+			fileuuid   string
+			filename   string
+			owner      string
+			permission string
+		)
+		if err := rows.Scan(&fileuuid, &filename, &owner, &permission); err != nil {
+			return nil, fmt.Errorf("could not copy values from database: %w", err)
+		}
+		list = append(list, gin.H{
+			"UUID":       fileuuid,
+			"Name":       filename,
+			"Owner":      owner,
+			"Permission": permission,
+		})
+	}
+
+	return list, rows.Err()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Signed URLs are valid for an hour unless asked otherwise.
+const signedExpiry = time.Hour
+
+var errAddress = errors.New("invalid IP address")
+
+// signature authenticates a signed URL. It covers the file as well as the link,
+// so that rotating or revoking the link invalidates the URL.
+func signature(key []byte, name string, fileuuid string, expires int64, ip string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", name, fileuuid, expires, ip)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedPath returns the path of a URL which downloads a file without its
+// password until it expires, optionally only for a single IP address. The
+// oldest link of the file is used, and one is created if it has none.
+func signedPath(db *sql.DB, key []byte, fileuuid string, expires time.Time, ip string) (string, error) {
+	if ip != "" {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return "", errAddress
+		}
+		ip = parsed.String()
+	}
+
+	name, err := firstLink(db, fileuuid)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		name, err = createLink(db, shareLink{File: fileuuid})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if ip != "" {
+		q.Set("ip", ip)
+	}
+	q.Set("signature", signature(key, name, fileuuid, expires.Unix(), ip))
+
+	return "/downloads/" + name + "?" + q.Encode(), nil
+}
+
+// validSignature reports whether a request to download through a link carries
+// a signature which has not expired and was made for the client.
+func validSignature(ctx *gin.Context, key []byte, l shareLink) bool {
+	expires, err := strconv.ParseInt(ctx.Query("expires"), 10, 64)
+	if err != nil || expires <= time.Now().Unix() {
+		return false
+	}
+
+	ip := ctx.Query("ip")
+	if ip != "" && ip != ctx.ClientIP() {
+		return false
+	}
+
+	expected := signature(key, l.Name, l.File, expires, ip)
+	return hmac.Equal([]byte(ctx.Query("signature")), []byte(expected))
+}
+
+func registerSigning(router *gin.Engine, db *sql.DB, c config, key []byte) {
+	// Scripts authenticate like they do for uploads.
+	router.POST("/api/files/:uuid/sign", func(ctx *gin.Context) {
+		userid, err := putUser(ctx, db, c)
+		if err != nil {
+			log.Printf("Rejected signing: %s", err.Error())
+			ctx.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Unauthorized",
+			})
+			return
+		}
+
+		fileuuid := ctx.Param("uuid")
+
+		permission, err := access(db, fileuuid, userid)
+		if err != nil || !canManage(permission) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": "No such file",
+			})
+			return
+		}
+
+		var in struct {
+			Expiry string `json:"expiry"`
+			IP     string `json:"ip"`
+		}
+		if ctx.Request.ContentLength != 0 {
+			if err := ctx.ShouldBindJSON(&in); err != nil {
+				ctx.JSON(400, gin.H{
+					"error": "Malformed input",
+				})
+				return
+			}
+		}
+
+		d := signedExpiry
+		if in.Expiry != "" {
+			d, err = time.ParseDuration(in.Expiry)
+			if err != nil || d <= 0 {
+				ctx.JSON(400, gin.H{
+					"error": "Malformed expiry",
+				})
+				return
+			}
+		}
+		expires := time.Now().Add(d)
+
+		path, err := signedPath(db, key, fileuuid, expires, in.IP)
+		if errors.Is(err, errAddress) {
+			ctx.JSON(400, gin.H{
+				"error": "Malformed IP address",
+			})
+			return
+		}
+		if err != nil {
+			log.Printf("Unable to sign URL: %s", err.Error())
+			ctx.JSON(500, gin.H{
+				"error": "Unable to sign URL",
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{
+			"url":     link(ctx, c, path),
+			"expires": expires.Unix(),
+		})
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidSignature(t *testing.T) {
+	key := []byte("key")
+	l := shareLink{
+		Name: "h7LVMGWYHh",
+		File: "file-uuid",
+	}
+
+	// httptest requests come from 192.0.2.1.
+	const client = "192.0.2.1"
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Second).Unix()
+
+	query := func(expires int64, ip string, sig string) url.Values {
+		q := url.Values{}
+		q.Set("expires", strconv.FormatInt(expires, 10))
+		if ip != "" {
+			q.Set("ip", ip)
+		}
+		q.Set("signature", sig)
+		return q
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		valid bool
+	}{
+		{"valid", query(future, "", signature(key, l.Name, l.File, future, "")), true},
+		{"valid for the client", query(future, client, signature(key, l.Name, l.File, future, client)), true},
+		{"expired", query(past, "", signature(key, l.Name, l.File, past, "")), false},
+		{"extended", query(future+1, "", signature(key, l.Name, l.File, future, "")), false},
+		{"malformed expiry", url.Values{"expires": {"soon"}, "signature": {signature(key, l.Name, l.File, future, "")}}, false},
+		{"other link", query(future, "", signature(key, "other", l.File, future, "")), false},
+		{"other file", query(future, "", signature(key, l.Name, "other-uuid", future, "")), false},
+		{"other client", query(future, "198.51.100.7", signature(key, l.Name, l.File, future, "198.51.100.7")), false},
+		{"address removed", query(future, "", signature(key, l.Name, l.File, future, client)), false},
+		{"address added", query(future, client, signature(key, l.Name, l.File, future, "")), false},
+		{"other key", query(future, "", signature([]byte("other"), l.Name, l.File, future, "")), false},
+		{"missing signature", query(future, "", ""), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+			ctx.Request = httptest.NewRequest(http.MethodGet, "/downloads/"+l.Name+"?"+tt.query.Encode(), nil)
+
+			if valid := validSignature(ctx, key, l); valid != tt.valid {
+				t.Fatalf("got %t, want %t", valid, tt.valid)
+			}
+		})
+	}
+}
+
+func TestSignedDownload(t *testing.T) {
+	db := testDB(t)
+
+	var c config
+	c.Data = t.TempDir()
+	secret := []byte("secret")
+
+	owner, err := createUser(db, "alice", "password", roleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileuuid := testFile(t, db, c.Data, owner, "report.txt", "contents")
+
+	password, err := hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		UPDATE file
+		SET password = ?
+		WHERE uuid = ?
+	`, password, fileuuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.Use(sessions.Sessions("session", newStore(db, time.Hour, time.Hour, secret)))
+	register(router, db, c, secret)
+
+	get := func(t *testing.T, path string) (int, string) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		body, err := io.ReadAll(w.Result().Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return w.Code, string(body)
+	}
+
+	path, err := signedPath(db, deriveKey(secret, "sign"), fileuuid, time.Now().Add(time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := firstLink(db, fileuuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(path, "/downloads/"+name+"?") {
+		t.Fatalf("signed %s instead of a URL for link %s", path, name)
+	}
+
+	t.Run("unsigned", func(t *testing.T) {
+		code, body := get(t, "/downloads/"+name)
+		if code != http.StatusOK || body == "contents" {
+			t.Fatalf("downloaded a protected file without its password: %d %q", code, body)
+		}
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		code, body := get(t, path)
+		if code != http.StatusOK || body != "contents" {
+			t.Fatalf("got %d %q", code, body)
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		code, body := get(t, strings.Replace(path, "signature=", "signature=x", 1))
+		if code != http.StatusForbidden || body == "contents" {
+			t.Fatalf("got %d %q", code, body)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		if err := revokeLink(db, fileuuid, name); err != nil {
+			t.Fatal(err)
+		}
+
+		code, body := get(t, path)
+		if code == http.StatusOK || body == "contents" {
+			t.Fatalf("downloaded through a revoked link: %d %q", code, body)
+		}
+	})
+
+	var downloads int64
+	if err := db.QueryRow(`SELECT downloads FROM file WHERE uuid = ?`, fileuuid).Scan(&downloads); err != nil {
+		t.Fatal(err)
+	}
+	if downloads != 1 {
+		t.Fatalf("counted %d downloads, want 1", downloads)
+	}
+}
@@ -6,57 +6,142 @@ const whenReady = callback => {
     }
 };
 
+const post = async (url, body) => {
+    const responseRaw = await fetch(url, {
+        method: 'POST',
+        body: body instanceof FormData ? body : JSON.stringify(body),
+        headers: body instanceof FormData ? {
+            'Accept': 'application/json'
+        } : {
+            'Content-Type': 'application/json',
+            'Accept': 'application/json'
+        }
+    });
+
+    if (!responseRaw.ok) {
+        throw new Error(`Server responded with code ${responseRaw.status}.`);
+    }
+
+    return await responseRaw.json();
+};
+
+// Collect the files of a dropped directory entry along with their paths.
+const walk = async entry => {
+    if (entry.isFile) {
+        const file = await new Promise((resolve, reject) => entry.file(resolve, reject));
+        return [{ file, path: entry.fullPath.replace(/^\//, '') }];
+    }
+
+    const reader = entry.createReader();
+    const found = [];
+
+    // Directory readers return their entries in batches.
+    for (;;) {
+        const batch = await new Promise((resolve, reject) => reader.readEntries(resolve, reject));
+        if (batch.length === 0) {
+            break;
+        }
+
+        for (const child of batch) {
+            found.push(...await walk(child));
+        }
+    }
+
+    return found;
+};
+
 whenReady(() => {
     const uploadForm = document.querySelector('form#upload');
 
-    const bar = document.createElement('div');
-    bar.classList.add('bar');
+    if (uploadForm === null) {
+        return;
+    }
 
-    const progress = document.createElement('div');
-    progress.classList.add('progress');
-    progress.style.width = '0%';
+    const fileElement = uploadForm.querySelector('input[type="file"]#file');
+    const folderElement = uploadForm.querySelector('input[type="file"]#folder');
 
-    const description = document.createElement('div');
-    description.classList.add('description');
+    // Files can also come from the folder picker or be dropped onto the form.
+    fileElement.required = false;
 
-    progress.appendChild(description);
+    const queue = document.createElement('ul');
+    queue.classList.add('queue');
 
-    bar.appendChild(progress);
+    uploadForm.parentElement.appendChild(queue);
 
-    uploadForm.parentElement.appendChild(bar);
+    let dropped = [];
 
-    uploadForm.addEventListener('submit', async event => {
+    uploadForm.addEventListener('dragover', event => {
         event.preventDefault();
+        uploadForm.classList.add('dragging');
+    });
 
-        const fileElement = event.target.querySelector('input[type="file"]#file');
+    uploadForm.addEventListener('dragleave', () => {
+        uploadForm.classList.remove('dragging');
+    });
 
-        if (fileElement.files.length !== 1) {
-            return;
+    uploadForm.addEventListener('drop', async event => {
+        event.preventDefault();
+        uploadForm.classList.remove('dragging');
+
+        const entries = [...event.dataTransfer.items]
+            .map(item => item.webkitGetAsEntry ? item.webkitGetAsEntry() : null);
+
+        if (entries.some(entry => entry === null)) {
+            dropped = [...event.dataTransfer.files].map(file => ({ file, path: file.name }));
+        } else {
+            dropped = [];
+            for (const entry of entries) {
+                dropped.push(...await walk(entry));
+            }
         }
 
-        const file = fileElement.files[0];
+        fileElement.setCustomValidity('');
+        fileElement.title = `${dropped.length} file(s) dropped`;
+    });
 
-        const chunkSize = parseInt(fileElement.dataset.chunkSize);
+    const selected = () => {
+        if (dropped.length > 0) {
+            return dropped;
+        }
 
-        const responseRawPrepare = await fetch('/prepare', {
-            method: 'POST',
-            body: JSON.stringify({
-                password: event.target.elements.password.value || null,
-                time: parseInt(event.target.elements.time.value),
-                unit: event.target.elements.unit.value,
-                filename: file.name
-            }),
-            headers: {
-                'Content-Type': 'application/json',
-                'Accept': 'application/json'
-            }
-        });
+        const files = [...fileElement.files].map(file => ({ file, path: file.name }));
 
-        if (!responseRawPrepare.ok) {
-            throw new Error(`Server responded with code ${responseRawPrepare.status}.`);
+        if (folderElement !== null) {
+            files.push(...[...folderElement.files].map(file => ({ file, path: file.webkitRelativePath || file.name })));
         }
 
-        const responsePrepare = await responseRawPrepare.json();
+        return files;
+    };
+
+    // Name bundles after the folder all files are in, if there is one.
+    const bundleName = files => {
+        const roots = new Set(files.map(({ path }) => path.includes('/') ? path.split('/')[0] : null));
+
+        if (roots.size === 1 && !roots.has(null)) {
+            return [...roots][0];
+        }
+
+        return `Upload ${new Date().toISOString().slice(0, 10)}`;
+    };
+
+    const send = async ({ file, path }, item) => {
+        const progress = item.querySelector('div.progress');
+        const description = item.querySelector('div.description');
+
+        const chunkSize = parseInt(fileElement.dataset.chunkSize);
+
+        // File requests have their own endpoints and leave the expiry to the requester.
+        const base = uploadForm.dataset.base || '';
+        const elements = uploadForm.elements;
+
+        const responsePrepare = await post(`${base}/prepare`, {
+            password: elements.password ? elements.password.value || null : null,
+            time: elements.time ? parseInt(elements.time.value) : null,
+            unit: elements.unit ? elements.unit.value : null,
+            filename: path,
+            size: file.size,
+            strip: elements.strip ? elements.strip.value === 'true' : null
+        });
 
         if (typeof responsePrepare.uuid !== 'string') {
             throw new Error('Could not get UUID of file entry.');
@@ -66,44 +151,89 @@ whenReady(() => {
 
         for (let start = 0; start < file.size; start += chunkSize) {
             progress.style.width = `${start / file.size * 100}%`;
-            description.innerText = `Sending chunk ${start / chunkSize + 1}/${Math.ceil(file.size / chunkSize)}`;
-
-            const chunk = file.slice(start, start + chunkSize)
+            description.innerText = `${path}: sending chunk ${start / chunkSize + 1}/${Math.ceil(file.size / chunkSize)}`;
 
             const chunkFormData = new FormData();
-            chunkFormData.set('chunk', chunk);
-
-            const responseRawAppend = await fetch(`/append/${encodeURIComponent(uuid)}`, {
-                method: 'POST',
-                body: chunkFormData,
-                headers: {
-                    'Accept': 'application/json'
-                }
-            });
+            chunkFormData.set('chunk', file.slice(start, start + chunkSize));
 
-            if (!responseRawAppend.ok) {
-                throw new Error(`Server responded with code ${responseRawAppend.status}.`);
-            }
+            await post(`${base}/append/${encodeURIComponent(uuid)}`, chunkFormData);
+        }
+
+        await post(`${base}/finish/${encodeURIComponent(uuid)}`, {});
+
+        progress.style.width = '100%';
+        description.innerText = `${path}: done`;
+
+        return uuid;
+    };
+
+    uploadForm.addEventListener('submit', async event => {
+        event.preventDefault();
+
+        const files = selected();
 
-            await responseRawAppend.blob();
+        if (files.length === 0) {
+            fileElement.setCustomValidity('Select at least one file.');
+            fileElement.reportValidity();
+            return;
         }
 
-        const responseRawFinish = await fetch(`/finish/${uuid}`, {
-            method: 'POST',
-            body: JSON.stringify({}),
-            headers: {
-                'Content-Type': 'application/json',
-                'Accept': 'application/json'
-            }
+        queue.replaceChildren();
+
+        const items = files.map(({ path }) => {
+            const item = document.createElement('li');
+
+            const bar = document.createElement('div');
+            bar.classList.add('bar');
+
+            const progress = document.createElement('div');
+            progress.classList.add('progress');
+            progress.style.width = '0%';
+
+            const description = document.createElement('div');
+            description.classList.add('description');
+            description.innerText = `${path}: waiting`;
+
+            progress.appendChild(description);
+            bar.appendChild(progress);
+            item.appendChild(bar);
+            queue.appendChild(item);
+
+            return item;
         });
 
-        if (!responseRawFinish.ok) {
-            throw new Error(`Server responded with code ${responseRawFinish.status}.`);
+        const uploaded = [];
+        let failed = false;
+
+        for (const [i, file] of files.entries()) {
+            try {
+                uploaded.push(await send(file, items[i]));
+            } catch (error) {
+                failed = true;
+                items[i].classList.add('failed');
+                items[i].querySelector('div.description').innerText = `${file.path}: ${error.message}`;
+            }
         }
 
-        await responseRawFinish.json();
+        const bundle = uploadForm.elements.bundle ? uploadForm.elements.bundle.value : '';
+
+        if (bundle !== '' && uploaded.length > 0) {
+            await post('/bundle', {
+                kind: bundle,
+                name: bundleName(files),
+                files: uploaded,
+                password: uploadForm.elements.password ? uploadForm.elements.password.value || null : null
+            });
+        }
 
+        dropped = [];
         fileElement.value = null;
-        location.reload();
+        if (folderElement !== null) {
+            folderElement.value = null;
+        }
+
+        if (!failed) {
+            location.reload();
+        }
     });
 });
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base32"
+	"encoding/gob"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+)
+
+// store keeps sessions in the database, so that the cookie only carries an
+// opaque token which can be revoked on the server.
+type store struct {
+	db      *sql.DB
+	codecs  []securecookie.Codec
+	options *gsessions.Options
+	idle    time.Duration
+	maxAge  time.Duration
+}
+
+func newStore(db *sql.DB, idle time.Duration, maxAge time.Duration, keyPairs ...[]byte) *store {
+	return &store{
+		db:     db,
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		options: &gsessions.Options{
+			Path:     "/",
+			MaxAge:   int(maxAge.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		idle:   idle,
+		maxAge: maxAge,
+	}
+}
+
+func (s *store) Options(options sessions.Options) {
+	s.options = options.ToGorillaOptions()
+}
+
+func (s *store) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *store) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var token string
+	if err := securecookie.DecodeMulti(name, c.Value, &token, s.codecs...); err != nil {
+		// Stale or forged cookies simply result in a new session.
+		return session, nil
+	}
+
+	row := s.db.QueryRow(`
+		SELECT data, created, accessed
+		FROM session
+		WHERE token = ?
+	`, hashToken(token))
+
+	var (
+		data     []byte
+		created  int64
+		accessed int64
+	)
+	if err := row.Scan(&data, &created, &accessed); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return session, nil
+		}
+		return session, err
+	}
+
+	now := time.Now()
+	if now.Sub(time.Unix(created, 0)) > s.maxAge || now.Sub(time.Unix(accessed, 0)) > s.idle {
+		_, err := s.db.Exec(`
+			DELETE FROM session
+			WHERE token = ?
+		`, hashToken(token))
+		return session, err
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE session
+		SET accessed = ?
+		WHERE token = ?
+	`, now.Unix(), hashToken(token))
+	if err != nil {
+		return session, err
+	}
+
+	session.ID = token
+	session.IsNew = false
+
+	return session, nil
+}
+
+func (s *store) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	// Cleared sessions are removed entirely instead of being stored empty.
+	if session.Options.MaxAge < 0 || len(session.Values) == 0 {
+		if session.ID != "" {
+			_, err := s.db.Exec(`
+				DELETE FROM session
+				WHERE token = ?
+			`, hashToken(session.ID))
+			if err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), "", &gsessions.Options{
+			Path:   session.Options.Path,
+			Domain: session.Options.Domain,
+			MaxAge: -1,
+		}))
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+
+	var userid sql.NullInt64
+	if uid, ok := session.Values["user_id"].(int); ok {
+		userid = sql.NullInt64{
+			Int64: int64(uid),
+			Valid: true,
+		}
+	}
+
+	if session.ID != "" {
+		row := s.db.QueryRow(`
+			SELECT user_id
+			FROM session
+			WHERE token = ?
+		`, hashToken(session.ID))
+
+		var previous sql.NullInt64
+		err := row.Scan(&previous)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// The session has been revoked in the meantime.
+			session.ID = ""
+		case err != nil:
+			return err
+		case previous != userid:
+			// Issue a new token whenever the authenticated user changes.
+			_, err := s.db.Exec(`
+				DELETE FROM session
+				WHERE token = ?
+			`, hashToken(session.ID))
+			if err != nil {
+				return err
+			}
+			session.ID = ""
+		default:
+			_, err := s.db.Exec(`
+				UPDATE session
+				SET data = ?
+				WHERE token = ?
+			`, buf.Bytes(), hashToken(session.ID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if session.ID == "" {
+		session.ID = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(securecookie.GenerateRandomKey(32))
+
+		now := time.Now().Unix()
+		_, err := s.db.Exec(`
+			INSERT INTO session (token, user_id, data, created, accessed, address, agent)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, hashToken(session.ID), userid, buf.Bytes(), now, now, r.RemoteAddr, r.UserAgent())
+		if err != nil {
+			return err
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), encoded, session.Options))
+
+	return nil
+}
+
+func (s *store) collect(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		_, err := s.db.Exec(`
+			DELETE FROM session
+			WHERE created < ?
+			OR accessed < ?
+		`, now.Add(-s.maxAge).Unix(), now.Add(-s.idle).Unix())
+		if err != nil {
+			log.Printf("Unable to delete expired sessions: %s", err.Error())
+		}
+	}
+}
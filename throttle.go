@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rates are given in bytes per second and counts in concurrent downloads, with
+// 0 meaning that there is no limit.
+type limitsConfig struct {
+	Egress     int `toml:"egress_rate"`
+	Connection int `toml:"connection_rate"`
+	File       int `toml:"file_rate"`
+	Ingress    int `toml:"ingress_rate"`
+
+	Downloads       int `toml:"concurrent_downloads"`
+	FileDownloads   int `toml:"concurrent_downloads_per_file"`
+	ClientDownloads int `toml:"concurrent_downloads_per_ip"`
+}
+
+const (
+	// Data is passed through the token buckets in pieces of at most this size,
+	// so that transfers sharing a bucket take turns.
+	throttleChunk = 32 * 1024
+
+	// Clients turned away because of too many concurrent downloads are asked to
+	// try again after this many seconds.
+	retryAfter = 10
+)
+
+// bucket is a token bucket shared by all transfers of a file or a user.
+type bucket struct {
+	limiter *rate.Limiter
+	users   int
+}
+
+// meter counts the bytes passing through it and the rate at which they did so
+// during the last second.
+type meter struct {
+	total atomic.Int64
+	rate  atomic.Int64
+	last  int64
+}
+
+func (m *meter) tick() {
+	total := m.total.Load()
+	m.rate.Store(total - m.last)
+	m.last = total
+}
+
+type throttle struct {
+	limits limitsConfig
+	egress *rate.Limiter
+
+	mu    sync.Mutex
+	files map[string]*bucket
+	users map[string]*bucket
+
+	// Downloads in progress, in total, by file and by client.
+	downloads int
+	active    map[string]int
+	clients   map[string]int
+
+	sent     meter
+	received meter
+}
+
+func newLimiter(bps int) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bps), bps)
+}
+
+func newThrottle(c config) *throttle {
+	t := &throttle{
+		limits:  c.Limits,
+		egress:  newLimiter(c.Limits.Egress),
+		files:   map[string]*bucket{},
+		users:   map[string]*bucket{},
+		active:  map[string]int{},
+		clients: map[string]int{},
+	}
+
+	go func() {
+		for range time.Tick(time.Second) {
+			t.sent.tick()
+			t.received.tick()
+		}
+	}()
+
+	return t
+}
+
+// share returns the bucket for a key, creating it if it is not in use yet, and
+// a function to give it back.
+func (t *throttle) share(buckets map[string]*bucket, key string, bps int) (*rate.Limiter, func()) {
+	if bps <= 0 {
+		return nil, func() {}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{limiter: newLimiter(bps)}
+		buckets[key] = b
+	}
+	b.users++
+
+	return b.limiter, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		b.users--
+		if b.users == 0 {
+			delete(buckets, key)
+		}
+	}
+}
+
+// wait takes n tokens from each of the buckets.
+func wait(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, l := range limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunk returns how much data can be passed through the buckets at once.
+func chunk(limiters []*rate.Limiter) int {
+	n := throttleChunk
+	for _, l := range limiters {
+		if l.Burst() < n {
+			n = l.Burst()
+		}
+	}
+	return n
+}
+
+func present(limiters ...*rate.Limiter) []*rate.Limiter {
+	var ls []*rate.Limiter
+	for _, l := range limiters {
+		if l != nil {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+type throttledWriter struct {
+	gin.ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+	meter    *meter
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if c := chunk(w.limiters); n > c {
+			n = c
+		}
+
+		if err := wait(w.ctx, w.limiters, n); err != nil {
+			return written, err
+		}
+
+		n, err := w.ResponseWriter.Write(p[:n])
+		written += n
+		w.meter.total.Add(int64(n))
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*rate.Limiter
+	meter    *meter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if c := chunk(r.limiters); len(p) > c {
+		p = p[:c]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	r.meter.total.Add(int64(n))
+	if n > 0 {
+		if werr := wait(r.ctx, r.limiters, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// begin admits a download of a file, or of several files if fileuuid is
+// empty, and slows it down according to the bandwidth limits. Once too many
+// downloads are in progress, the request is answered with 429 Too Many
+// Requests instead. The returned function has to be called once the response
+// has been sent.
+func (t *throttle) begin(ctx *gin.Context, fileuuid string) (func(), bool) {
+	ip := ctx.ClientIP()
+
+	t.mu.Lock()
+	full := (t.limits.Downloads > 0 && t.downloads >= t.limits.Downloads) ||
+		(t.limits.ClientDownloads > 0 && t.clients[ip] >= t.limits.ClientDownloads) ||
+		(fileuuid != "" && t.limits.FileDownloads > 0 && t.active[fileuuid] >= t.limits.FileDownloads)
+	if !full {
+		t.downloads++
+		t.clients[ip]++
+		if fileuuid != "" {
+			t.active[fileuuid]++
+		}
+	}
+	t.mu.Unlock()
+
+	if full {
+		ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+		ctx.String(http.StatusTooManyRequests, "Too many downloads, try again later\n")
+		return nil, false
+	}
+
+	release := t.limitEgress(ctx, fileuuid)
+
+	return func() {
+		release()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		t.downloads--
+		if t.clients[ip]--; t.clients[ip] == 0 {
+			delete(t.clients, ip)
+		}
+		if fileuuid != "" {
+			if t.active[fileuuid]--; t.active[fileuuid] == 0 {
+				delete(t.active, fileuuid)
+			}
+		}
+	}, true
+}
+
+// downloading returns the number of downloads in progress and how many of
+// them there are for each file.
+func (t *throttle) downloading() (int, map[string]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	active := make(map[string]int, len(t.active))
+	for fileuuid, n := range t.active {
+		active[fileuuid] = n
+	}
+
+	return t.downloads, active
+}
+
+// limitEgress slows down everything sent in response to a request according to
+// the global, per-connection and per-file limits. The returned function has to
+// be called once the response has been sent.
+func (t *throttle) limitEgress(ctx *gin.Context, fileuuid string) func() {
+	var file *rate.Limiter
+	release := func() {}
+	if fileuuid != "" {
+		file, release = t.share(t.files, fileuuid, t.limits.File)
+	}
+
+	ctx.Writer = &throttledWriter{
+		ResponseWriter: ctx.Writer,
+		ctx:            ctx.Request.Context(),
+		limiters:       present(t.egress, newLimiter(t.limits.Connection), file),
+		meter:          &t.sent,
+	}
+
+	return release
+}
+
+// limitIngress slows down receiving the body of a request according to the
+// limit of the user who is going to own the upload. The returned function has
+// to be called once the body has been read.
+func (t *throttle) limitIngress(ctx *gin.Context, owner interface{}) func() {
+	user, release := t.share(t.users, fmt.Sprint(owner), t.limits.Ingress)
+
+	ctx.Request.Body = &throttledReader{
+		ReadCloser: ctx.Request.Body,
+		ctx:        ctx.Request.Context(),
+		limiters:   present(user),
+		meter:      &t.received,
+	}
+
+	return release
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	_ "image/gif"
+	_ "image/jpeg"
+
+	_ "golang.org/x/image/webp"
+
+	"golang.org/x/image/draw"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	thumbnailSize = 256
+
+	// Larger images are not decoded, since that would take up too much memory.
+	maxPixels = 50 * 1000 * 1000
+)
+
+var errNoImage = errors.New("not a supported image")
+
+func thumbnailPath(data string, fileuuid string) string {
+	return filepath.Join(data, fileuuid+".thumb")
+}
+
+func hasThumbnail(data string, fileuuid string) bool {
+	_, err := os.Stat(thumbnailPath(data, fileuuid))
+	return err == nil
+}
+
+// createThumbnail scales an image down so that it fits into a square of
+// thumbnailSize pixels and stores it as a PNG next to the file.
+func createThumbnail(data string, fileuuid string) error {
+	file, err := os.Open(filepath.Join(data, fileuuid))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return errNoImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxPixels {
+		return errNoImage
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return errNoImage
+	}
+
+	width, height := config.Width, config.Height
+	switch {
+	case width > height && width > thumbnailSize:
+		width, height = thumbnailSize, height*thumbnailSize/width
+	case height > thumbnailSize:
+		width, height = width*thumbnailSize/height, thumbnailSize
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	// Write to a temporary file first, so that no partial thumbnail is served.
+	tmp := thumbnailPath(data, fileuuid) + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = png.Encode(out, dst)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, thumbnailPath(data, fileuuid)); err != nil {
+		return err
+	}
+
+	// The file might have been removed in the meantime.
+	if _, err := os.Stat(filepath.Join(data, fileuuid)); errors.Is(err, os.ErrNotExist) {
+		return os.Remove(thumbnailPath(data, fileuuid))
+	}
+
+	return nil
+}
+
+func registerThumbnails(priv *gin.RouterGroup, db *sql.DB, c config) {
+	priv.GET("/files/:uuid/thumbnail", func(ctx *gin.Context) {
+		fileuuid := ctx.Param("uuid")
+
+		permission, err := access(db, fileuuid, sessions.Default(ctx).Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to check access: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		if permission == "" || !hasThumbnail(c.Data, fileuuid) {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		ctx.Header("Content-Type", "image/png")
+		ctx.Header("Cache-Control", "private, max-age=86400")
+		ctx.File(thumbnailPath(c.Data, fileuuid))
+	})
+}
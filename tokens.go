@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createToken creates an API token, which lets scripts act on behalf of a user
+// without their password. Like for invitations, only its hash is stored.
+func createToken(db *sql.DB, userid interface{}, name string) (string, error) {
+	token := randomString(32)
+
+	_, err := db.Exec(`
+		INSERT INTO api_token (token, user_id, name, created)
+		VALUES (?, ?, ?, ?)
+	`, hashToken(token), userid, name, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// tokenUser returns the user an API token belongs to and records its use.
+func tokenUser(db *sql.DB, token string) (int, error) {
+	row := db.QueryRow(`
+		SELECT user_id
+		FROM api_token
+		WHERE token = ?
+	`, hashToken(token))
+
+	var userid int
+	if err := row.Scan(&userid); err != nil {
+		return 0, err
+	}
+
+	_, err := db.Exec(`
+		UPDATE api_token
+		SET used = ?
+		WHERE token = ?
+	`, time.Now().Unix(), hashToken(token))
+	if err != nil {
+		log.Printf("Unable to record use of token: %s", err.Error())
+	}
+
+	return userid, nil
+}
+
+func tokens(db *sql.DB, userid interface{}) ([]gin.H, error) {
+	rows, err := db.Query(`
+		SELECT id, name, created, used
+		FROM api_token
+		WHERE user_id = ?
+		ORDER BY created DESC
+	`, userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []gin.H
+	for rows.Next() {
+		var (
+			id      int
+			name    string
+			created int64
+			used    sql.NullInt64
+		)
+		if err := rows.Scan(&id, &name, &created, &used); err != nil {
+			return nil, err
+		}
+
+		h := gin.H{
+			"ID":      id,
+			"Name":    name,
+			"Created": time.Unix(created, 0),
+		}
+		if used.Valid {
+			h["Used"] = time.Unix(used.Int64, 0)
+		}
+		list = append(list, h)
+	}
+
+	return list, rows.Err()
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	totpPeriod = 30
+
+	// After this many wrong codes in a row, the second factor of a user is
+	// locked for totpLockout, which doubles with every further round of
+	// failures up to totpMaxLockout.
+	totpMaxFailures = 5
+	totpLockout     = 30 * time.Second
+	totpMaxLockout  = time.Hour
+)
+
+func deriveKey(secret []byte, purpose string) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("hiraeth "+purpose)), key); err != nil {
+		log.Fatalf("Unable to derive key: %s", err.Error())
+	}
+	return key
+}
+
+func encrypt(key []byte, plaintext []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func decrypt(key []byte, ciphertext string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+}
+
+// matchTOTP returns the time step at which the code is valid, allowing for one
+// step of clock skew in either direction, or -1 if it does not match.
+func matchTOTP(secret string, code string, after int64) int64 {
+	now := time.Now()
+	for skew := -1; skew <= 1; skew++ {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		step := t.Unix() / totpPeriod
+		if step <= after {
+			continue
+		}
+
+		expected, err := totp.GenerateCodeCustom(secret, t, totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return -1
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step
+		}
+	}
+
+	return -1
+}
+
+// verifyTOTP checks a code against the enrolled secret of a user. Every time
+// step can only be used once.
+func verifyTOTP(db *sql.DB, key []byte, userid interface{}, code string) (bool, error) {
+	row := db.QueryRow(`
+		SELECT totp_secret, totp_step
+		FROM user
+		WHERE id = ?
+		AND totp_secret IS NOT NULL
+	`, userid)
+
+	var (
+		sealed string
+		last   int64
+	)
+	if err := row.Scan(&sealed, &last); err != nil {
+		return false, err
+	}
+
+	secret, err := decrypt(key, sealed)
+	if err != nil {
+		return false, err
+	}
+
+	step := matchTOTP(string(secret), strings.TrimSpace(code), last)
+	if step < 0 {
+		return false, nil
+	}
+
+	res, err := db.Exec(`
+		UPDATE user
+		SET totp_step = ?
+		WHERE id = ?
+		AND totp_step < ?
+	`, step, userid, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// totpLocked reports whether the second factor of a user is locked because of
+// too many wrong codes.
+func totpLocked(db *sql.DB, userid interface{}) (bool, error) {
+	row := db.QueryRow(`
+		SELECT totp_locked IS NOT NULL AND totp_locked > ?
+		FROM user
+		WHERE id = ?
+	`, time.Now().Unix(), userid)
+
+	var locked bool
+	err := row.Scan(&locked)
+	return locked, err
+}
+
+// failTOTP records a wrong code. The failures are kept with the user rather
+// than the session, so that logging in again does not allow further guesses.
+// It reports whether the second factor is locked.
+func failTOTP(db *sql.DB, userid interface{}) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Codes entered while locked are not counted, and checking the lock in
+	// the same statement keeps concurrent attempts from slipping past it.
+	now := time.Now()
+	var failures int
+	err = tx.QueryRow(`
+		UPDATE user
+		SET totp_failures = totp_failures + 1
+		WHERE id = ?
+		AND (totp_locked IS NULL OR totp_locked <= ?)
+		RETURNING totp_failures
+	`, userid, now.Unix()).Scan(&failures)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	threshold := (failures-1)/totpMaxFailures*totpMaxFailures + totpMaxFailures
+	if failures < threshold {
+		return false, tx.Commit()
+	}
+
+	lockout := totpLockout
+	for i := totpMaxFailures; i < failures && lockout < totpMaxLockout; i += totpMaxFailures {
+		lockout *= 2
+	}
+	if lockout > totpMaxLockout {
+		lockout = totpMaxLockout
+	}
+
+	_, err = tx.Exec(`
+		UPDATE user
+		SET totp_locked = ?
+		WHERE id = ?
+	`, now.Add(lockout).Unix(), userid)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func resetTOTPFailures(db *sql.DB, userid interface{}) error {
+	_, err := db.Exec(`
+		UPDATE user
+		SET
+			totp_failures = 0,
+			totp_locked = NULL
+		WHERE id = ?
+	`, userid)
+	return err
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func redeemRecoveryCode(db *sql.DB, userid interface{}, code string) (bool, error) {
+	res, err := db.Exec(`
+		DELETE FROM recovery_code
+		WHERE user_id = ?
+		AND code = ?
+	`, userid, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func newRecoveryCodes(db *sql.DB, userid interface{}) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM recovery_code
+		WHERE user_id = ?
+	`, userid)
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	for i := 0; i < 10; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+
+		_, err = tx.Exec(`
+			INSERT INTO recovery_code (user_id, code)
+			VALUES (?, ?)
+		`, userid, hashToken(code))
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code[:4]+"-"+code[4:])
+	}
+
+	return codes, tx.Commit()
+}
+
+func registerTOTP(router *gin.Engine, priv *gin.RouterGroup, db *sql.DB, c config, key []byte) {
+	issuer := c.Name
+	if issuer == "" {
+		issuer = "hiraeth"
+	}
+
+	enrollment := func(ctx *gin.Context, userid interface{}) (gin.H, error) {
+		session := sessions.Default(ctx)
+
+		row := db.QueryRow(`
+			SELECT name, totp_secret IS NOT NULL
+			FROM user
+			WHERE id = ?
+		`, userid)
+
+		var (
+			name     string
+			enrolled bool
+		)
+		if err := row.Scan(&name, &enrolled); err != nil {
+			return nil, err
+		}
+
+		if enrolled {
+			return gin.H{
+				"Enrolled": true,
+				"Required": c.RequireTOTP,
+			}, nil
+		}
+
+		k, err := totp.Generate(totp.GenerateOpts{
+			Issuer:      issuer,
+			AccountName: name,
+			Period:      totpPeriod,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sealed, err := encrypt(key, []byte(k.Secret()))
+		if err != nil {
+			return nil, err
+		}
+
+		session.Set("totp_pending", sealed)
+		if err := session.Save(); err != nil {
+			return nil, err
+		}
+
+		img, err := k.Image(200, 200)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+
+		return gin.H{
+			"Enrolled": false,
+			"Required": c.RequireTOTP,
+			"Secret":   k.Secret(),
+			"QR":       template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())),
+		}, nil
+	}
+
+	router.GET("/login/totp", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+		if session.Get("pending_user_id") == nil {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		ctx.HTML(http.StatusOK, "verify", gin.H{})
+	})
+
+	router.POST("/login/totp", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		userid := session.Get("pending_user_id")
+		if userid == nil {
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		var in struct {
+			Code string `form:"code" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/login/totp")
+			return
+		}
+
+		// No codes are checked while the second factor is locked, so that it
+		// cannot be guessed.
+		locked, err := totpLocked(db, userid)
+		if err != nil {
+			log.Printf("Could not query database: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+		if locked {
+			session.Clear()
+			session.Save()
+			ctx.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		ok, err := verifyTOTP(db, key, userid, in.Code)
+		if err != nil {
+			log.Printf("Unable to verify code: %s", err.Error())
+		}
+		if !ok {
+			ok, err = redeemRecoveryCode(db, userid, in.Code)
+			if err != nil {
+				log.Printf("Unable to redeem recovery code: %s", err.Error())
+			}
+		}
+
+		if !ok {
+			locked, err := failTOTP(db, userid)
+			if err != nil {
+				log.Printf("Unable to record failed attempt: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+
+			// Force the password to be entered again once the second factor
+			// has been locked.
+			if locked {
+				session.Clear()
+				session.Save()
+				ctx.Redirect(http.StatusFound, "/")
+				return
+			}
+
+			ctx.Redirect(http.StatusFound, "/login/totp")
+			return
+		}
+
+		if err := resetTOTPFailures(db, userid); err != nil {
+			log.Printf("Unable to reset failed attempts: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		session.Delete("pending_user_id")
+		session.Set("user_id", userid)
+		err = session.Save()
+		if err != nil {
+			log.Printf("Could not save data to session: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		ctx.Redirect(http.StatusFound, "/files/")
+	})
+
+	priv.GET("/totp/", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		h, err := enrollment(ctx, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to prepare enrollment: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		page(ctx, "totp", h)
+	})
+
+	priv.POST("/totp/enable", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			Code string `form:"code" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/totp/")
+			return
+		}
+
+		sealed, ok := session.Get("totp_pending").(string)
+		if !ok {
+			ctx.Redirect(http.StatusFound, "/totp/")
+			return
+		}
+
+		secret, err := decrypt(key, sealed)
+		if err != nil {
+			log.Printf("Unable to decrypt pending secret: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/totp/")
+			return
+		}
+
+		step := matchTOTP(string(secret), strings.TrimSpace(in.Code), 0)
+		if step < 0 {
+			ctx.Redirect(http.StatusFound, "/totp/")
+			return
+		}
+
+		_, err = db.Exec(`
+			UPDATE user
+			SET
+				totp_secret = ?,
+				totp_step = ?
+			WHERE id = ?
+		`, sealed, step, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to enable two-factor authentication: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		session.Delete("totp_pending")
+		session.Save()
+
+		codes, err := newRecoveryCodes(db, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to generate recovery codes: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		page(ctx, "totp", gin.H{
+			"Enrolled":      true,
+			"Required":      c.RequireTOTP,
+			"RecoveryCodes": codes,
+		})
+	})
+
+	priv.POST("/totp/recovery", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		var in struct {
+			Code string `form:"code" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/totp/")
+			return
+		}
+
+		ok, err := verifyTOTP(db, key, session.Get("user_id"), in.Code)
+		if err != nil || !ok {
+			ctx.Redirect(http.StatusFound, "/totp/")
+			return
+		}
+
+		codes, err := newRecoveryCodes(db, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to generate recovery codes: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		page(ctx, "totp", gin.H{
+			"Enrolled":      true,
+			"Required":      c.RequireTOTP,
+			"RecoveryCodes": codes,
+		})
+	})
+
+	priv.POST("/totp/disable", func(ctx *gin.Context) {
+		session := sessions.Default(ctx)
+
+		if c.RequireTOTP {
+			ctx.Redirect(http.StatusFound, "/totp/")
+			return
+		}
+
+		var in struct {
+			Code string `form:"code" binding:"required"`
+		}
+		err := ctx.ShouldBindWith(&in, binding.FormPost)
+		if err != nil {
+			log.Printf("Malformed input: %s", err.Error())
+			ctx.Redirect(http.StatusFound, "/totp/")
+			return
+		}
+
+		ok, err := verifyTOTP(db, key, session.Get("user_id"), in.Code)
+		if err != nil || !ok {
+			ctx.Redirect(http.StatusFound, "/totp/")
+			return
+		}
+
+		_, err = db.Exec(`
+			UPDATE user
+			SET
+				totp_secret = NULL,
+				totp_step = 0
+			WHERE id = ?
+		`, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to disable two-factor authentication: %s", err.Error())
+			ctx.AbortWithStatus(500)
+			return
+		}
+
+		_, err = db.Exec(`
+			DELETE FROM recovery_code
+			WHERE user_id = ?
+		`, session.Get("user_id"))
+		if err != nil {
+			log.Printf("Unable to delete recovery codes: %s", err.Error())
+		}
+
+		ctx.Redirect(http.StatusFound, "/totp/")
+	})
+}
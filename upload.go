@@ -0,0 +1,368 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errMetadata = errors.New("metadata does not match")
+	errChunk    = errors.New("chunk too large")
+	errTooLarge = errors.New("file too large")
+	errFull     = errors.New("request is full")
+)
+
+// upload describes a new file, which either belongs to a user directly or was
+// sent to them through a file request.
+type upload struct {
+	Name         string
+	Expiry       time.Time
+	Password     sql.NullString
+	Owner        interface{}
+	Request      sql.NullInt64
+	MaxDownloads sql.NullInt64
+	Language     sql.NullString
+
+	// Whether to remove metadata from images, which falls back to the
+	// configuration if it is not given.
+	Strip sql.NullBool
+}
+
+// uploader keeps track of files which are uploaded in chunks, so that they can
+// be removed if the upload is abandoned.
+type uploader struct {
+	db        *sql.DB
+	data      string
+	chunkSize int64
+	timeout   time.Duration
+	strip     bool
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+func newUploader(db *sql.DB, c config) *uploader {
+	return &uploader{
+		db:        db,
+		data:      c.Data,
+		chunkSize: c.ChunkSize,
+		timeout:   time.Duration(c.Timeout) * time.Second,
+		strip:     c.StripMetadata,
+		pending:   map[string]*time.Timer{},
+	}
+}
+
+func hashPassword(password string) (sql.NullString, error) {
+	if len(password) == 0 {
+		return sql.NullString{}, nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+
+	return sql.NullString{
+		String: string(hash),
+		Valid:  true,
+	}, nil
+}
+
+// insert adds the entry of a file. Files sent through a request take up one of
+// its slots, which is reserved by the same statement, so that concurrent
+// uploads cannot exceed the number of files the request allows.
+func (u *uploader) insert(fileuuid string, up upload, done bool, size int64) error {
+	strip := u.strip
+	if up.Strip.Valid {
+		strip = up.Strip.Bool
+	}
+
+	res, err := u.db.Exec(`
+		INSERT INTO file (uuid, name, expiry, password, done, owner_id, size, request_id, max_downloads, language, strip)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM request r
+			WHERE r.id = ?
+			AND r.max_files IS NOT NULL
+			AND r.max_files <= (
+				SELECT COUNT(*)
+				FROM file
+				WHERE request_id = r.id
+			)
+		)
+	`, fileuuid, up.Name, up.Expiry.Unix(), up.Password, done, up.Owner, size, up.Request, up.MaxDownloads, up.Language, strip, up.Request)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errFull
+	}
+
+	return nil
+}
+
+// save stores a file which has been uploaded in one piece.
+func (u *uploader) save(fh *multipart.FileHeader, up upload) (string, error) {
+	src, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	return u.store(src, fh.Size, up)
+}
+
+// store copies a file from a reader. The size is checked against the quota
+// before copying if it is known, which is not the case if it is negative.
+// Otherwise, copying stops as soon as the quota has been exceeded.
+func (u *uploader) store(src io.Reader, size int64, up upload) (string, error) {
+	if size >= 0 {
+		if err := checkQuota(u.db, up.Owner, size); err != nil {
+			return "", err
+		}
+	} else {
+		remaining, err := remainingQuota(u.db, up.Owner)
+		if err != nil {
+			return "", err
+		}
+		if remaining.Valid {
+			if remaining.Int64 < 0 {
+				return "", errQuota
+			}
+			src = io.LimitReader(src, remaining.Int64+1)
+		}
+	}
+
+	fileuuid := uuid.New().String()
+
+	dst, err := os.Create(filepath.Join(u.data, fileuuid))
+	if err != nil {
+		return "", err
+	}
+
+	n, err := io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size < 0 {
+		err = checkQuota(u.db, up.Owner, n)
+	}
+	if err != nil {
+		os.Remove(filepath.Join(u.data, fileuuid))
+		return "", err
+	}
+
+	if err := u.insert(fileuuid, up, true, n); err != nil {
+		os.Remove(filepath.Join(u.data, fileuuid))
+		return "", err
+	}
+
+	u.complete(fileuuid, up.Expiry)
+
+	return fileuuid, nil
+}
+
+// prepare creates the entry for a file which is going to be uploaded in
+// chunks. It is removed again unless a chunk arrives within the timeout.
+func (u *uploader) prepare(up upload) (string, error) {
+	fileuuid := uuid.New().String()
+
+	if err := u.insert(fileuuid, up, false, 0); err != nil {
+		return "", err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.pending[fileuuid] = time.AfterFunc(u.timeout, func() {
+		log.Printf("File %s timed out", fileuuid)
+		remove(fileuuid, u.data, u.db)
+
+		u.mu.Lock()
+		delete(u.pending, fileuuid)
+		u.mu.Unlock()
+	})
+
+	return fileuuid, nil
+}
+
+// append adds a chunk to an unfinished file. A positive limit restricts the
+// size of the whole file.
+func (u *uploader) append(fileuuid string, owner interface{}, fh *multipart.FileHeader, limit int64) error {
+	if fh.Size > u.chunkSize {
+		return errChunk
+	}
+
+	row := u.db.QueryRow(`
+		SELECT size
+		FROM file
+		WHERE uuid = ?
+		AND owner_id = ?
+		AND NOT done
+	`, fileuuid, owner)
+
+	var size int64
+	if err := row.Scan(&size); err != nil {
+		return errMetadata
+	}
+
+	if limit > 0 && size+fh.Size > limit {
+		return errTooLarge
+	}
+
+	if err := checkQuota(u.db, owner, fh.Size); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	timer, ok := u.pending[fileuuid]
+	u.mu.Unlock()
+	if !ok || !timer.Stop() {
+		return errMetadata
+	}
+	defer timer.Reset(u.timeout)
+
+	chunk, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer chunk.Close()
+
+	file, err := os.OpenFile(filepath.Join(u.data, fileuuid), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	// Append to the file identified by the UUID.
+	n, err := io.Copy(file, chunk)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = u.db.Exec(`
+		UPDATE file
+		SET size = size + ?
+		WHERE uuid = ?
+	`, n, fileuuid)
+
+	return err
+}
+
+func (u *uploader) finish(fileuuid string, owner interface{}) error {
+	row := u.db.QueryRow(`
+		SELECT expiry
+		FROM file
+		WHERE uuid = ?
+		AND owner_id = ?
+		AND NOT done
+	`, fileuuid, owner)
+
+	var expiry int64
+	if err := row.Scan(&expiry); err != nil {
+		return errMetadata
+	}
+
+	u.mu.Lock()
+	timer, ok := u.pending[fileuuid]
+	if ok {
+		delete(u.pending, fileuuid)
+	}
+	u.mu.Unlock()
+	if !ok || !timer.Stop() {
+		return errMetadata
+	}
+
+	_, err := u.db.Exec(`
+		UPDATE file
+		SET done = 1
+		WHERE uuid = ?
+	`, fileuuid)
+	if err != nil {
+		return err
+	}
+
+	u.complete(fileuuid, time.Unix(expiry, 0))
+
+	return nil
+}
+
+// complete is called once a file has been stored entirely.
+func (u *uploader) complete(fileuuid string, expiry time.Time) {
+	if err := u.stripMetadata(fileuuid); err != nil {
+		log.Printf("Unable to strip metadata from %s: %s", fileuuid, err.Error())
+	}
+
+	// The hash is taken last, since stripping metadata changes the contents.
+	if _, err := storeHash(u.db, u.data, fileuuid); err != nil {
+		log.Printf("Unable to hash %s: %s", fileuuid, err.Error())
+	}
+
+	watch(fileuuid, expiry, u.data, u.db)
+
+	if _, err := createLink(u.db, shareLink{File: fileuuid}); err != nil {
+		log.Printf("Unable to create link to %s: %s", fileuuid, err.Error())
+	}
+
+	go func() {
+		if err := createThumbnail(u.data, fileuuid); err != nil && !errors.Is(err, errNoImage) {
+			log.Printf("Unable to create thumbnail of %s: %s", fileuuid, err.Error())
+		}
+	}()
+}
+
+// stripMetadata removes metadata from a file if this has been asked for and
+// records whether it was applied.
+func (u *uploader) stripMetadata(fileuuid string) error {
+	row := u.db.QueryRow(`
+		SELECT strip
+		FROM file
+		WHERE uuid = ?
+	`, fileuuid)
+
+	var strip bool
+	if err := row.Scan(&strip); err != nil || !strip {
+		return err
+	}
+
+	path := filepath.Join(u.data, fileuuid)
+
+	stripped, err := stripMetadata(path)
+	if err != nil || !stripped {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = u.db.Exec(`
+		UPDATE file
+		SET
+			stripped = 1,
+			size = ?
+		WHERE uuid = ?
+	`, info.Size(), fileuuid)
+
+	return err
+}
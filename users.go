@@ -0,0 +1,401 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errNoUser = errors.New("no such user")
+	errNoHeir = errors.New("no such heir")
+	errQuota  = errors.New("quota exceeded")
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// authenticate checks the password of a user, either against the database or
+// against the directory.
+func authenticate(db *sql.DB, c config, name string, password string) (int, error) {
+	row := db.QueryRow(`
+		SELECT id, password, provider
+		FROM user
+		WHERE name = ?
+	`, name)
+
+	var (
+		userid   int
+		hash     string
+		provider sql.NullString
+	)
+	err := row.Scan(&userid, &hash, &provider)
+	switch {
+	case err == nil && !provider.Valid:
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return 0, err
+		}
+		return userid, nil
+	case (errors.Is(err, sql.ErrNoRows) || provider.String == "ldap") && c.LDAP.URL != "":
+		// Unknown users and users of the directory are authenticated against it.
+		userid, err = ldapLogin(db, c.LDAP, name, password)
+		if err != nil {
+			log.Printf("LDAP authentication of %s failed: %s", name, err.Error())
+			return 0, err
+		}
+		return userid, nil
+	case err != nil:
+		return 0, err
+	default:
+		return 0, fmt.Errorf("user %s cannot log in with a password", name)
+	}
+}
+
+func createUser(db execer, name string, password string, role string) (int, error) {
+	if name == "" || password == "" {
+		return 0, errors.New("name and password are required")
+	}
+	if !validRole(role) {
+		return 0, fmt.Errorf("invalid role %s", role)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := db.Exec(`
+		INSERT INTO user (name, password, role)
+		VALUES (?, ?, ?)
+	`, name, hash, role)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func lookupUser(db *sql.DB, name string) (int, error) {
+	row := db.QueryRow(`
+		SELECT id
+		FROM user
+		WHERE name = ?
+	`, name)
+
+	var id int
+	if err := row.Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, errNoUser
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func checkRows(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNoUser
+	}
+	return nil
+}
+
+// endSessions signs a user out everywhere.
+func endSessions(db execer, userid int) error {
+	_, err := db.Exec(`
+		DELETE FROM session
+		WHERE user_id = ?
+	`, userid)
+	return err
+}
+
+func renameUser(db *sql.DB, userid int, name string) error {
+	if name == "" {
+		return errors.New("name is required")
+	}
+
+	res, err := db.Exec(`
+		UPDATE user
+		SET name = ?
+		WHERE id = ?
+	`, name, userid)
+	if err != nil {
+		return err
+	}
+
+	return checkRows(res)
+}
+
+// resetPassword only applies to local users, since others authenticate
+// elsewhere.
+func resetPassword(db *sql.DB, userid int, password string) error {
+	if password == "" {
+		return errors.New("password is required")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec(`
+		UPDATE user
+		SET password = ?
+		WHERE id = ?
+		AND provider IS NULL
+	`, hash, userid)
+	if err != nil {
+		return err
+	}
+
+	if err := checkRows(res); err != nil {
+		return err
+	}
+
+	return endSessions(db, userid)
+}
+
+func disableUser(db *sql.DB, userid int, disabled bool) error {
+	res, err := db.Exec(`
+		UPDATE user
+		SET disabled = ?
+		WHERE id = ?
+	`, disabled, userid)
+	if err != nil {
+		return err
+	}
+
+	if err := checkRows(res); err != nil {
+		return err
+	}
+
+	if !disabled {
+		return nil
+	}
+
+	return endSessions(db, userid)
+}
+
+// deleteUser removes a user along with everything that belongs to them. Their
+// files are either handed over to another user or deleted as well. Nothing is
+// changed unless all of it succeeds.
+func deleteUser(db *sql.DB, data string, userid int, heir sql.NullInt64) error {
+	if heir.Valid && heir.Int64 == int64(userid) {
+		return errors.New("cannot reassign files to the deleted user")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var uuids []string
+	if heir.Valid {
+		var exists bool
+		err := tx.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1
+				FROM user
+				WHERE id = ?
+			)
+		`, heir).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errNoHeir
+		}
+
+		// Files sent through the requests of the user go to the heir as well.
+		for _, table := range []string{"file", "request", "collection"} {
+			_, err := tx.Exec(`
+				UPDATE `+table+`
+				SET owner_id = ?
+				WHERE owner_id = ?
+			`, heir, userid)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		rows, err := tx.Query(`
+			SELECT uuid
+			FROM file
+			WHERE owner_id = ?
+		`, userid)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var fileuuid string
+			if err := rows.Scan(&fileuuid); err != nil {
+				rows.Close()
+				return err
+			}
+			uuids = append(uuids, fileuuid)
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			DELETE FROM collection_file
+			WHERE file_uuid IN (
+				SELECT uuid
+				FROM file
+				WHERE owner_id = ?
+			)
+			OR collection_uuid IN (
+				SELECT uuid
+				FROM collection
+				WHERE owner_id = ?
+			)
+		`, userid, userid)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range []string{"share", "alias"} {
+			_, err := tx.Exec(`
+				DELETE FROM `+table+`
+				WHERE file_uuid IN (
+					SELECT uuid
+					FROM file
+					WHERE owner_id = ?
+				)
+			`, userid)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, table := range []string{"file", "request", "collection"} {
+			_, err := tx.Exec(`
+				DELETE FROM `+table+`
+				WHERE owner_id = ?
+			`, userid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := endSessions(tx, userid); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"recovery_code", "share", "api_token"} {
+		_, err := tx.Exec(`
+			DELETE FROM `+table+`
+			WHERE user_id = ?
+		`, userid)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Invitations are kept, so that the record of who was invited when and
+	// from where outlives the accounts involved.
+	for _, column := range []string{"creator_id", "user_id"} {
+		_, err := tx.Exec(`
+			UPDATE invitation
+			SET `+column+` = NULL
+			WHERE `+column+` = ?
+		`, userid)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.Exec(`
+		DELETE FROM user
+		WHERE id = ?
+	`, userid)
+	if err != nil {
+		return err
+	}
+	if err := checkRows(res); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// The contents of the files are only removed once they are no longer
+	// referenced.
+	for _, fileuuid := range uuids {
+		removeData(fileuuid, data)
+	}
+
+	log.Printf("Deleted user %d", userid)
+
+	return nil
+}
+
+// setQuota limits the total size of the files of a user. An invalid quota
+// removes the limit.
+func setQuota(db execer, userid int, quota sql.NullInt64) error {
+	res, err := db.Exec(`
+		UPDATE user
+		SET quota = ?
+		WHERE id = ?
+	`, quota, userid)
+	if err != nil {
+		return err
+	}
+
+	return checkRows(res)
+}
+
+// remainingQuota returns how many more bytes a user may store. It is invalid if
+// the user has no quota.
+func remainingQuota(db *sql.DB, userid interface{}) (sql.NullInt64, error) {
+	row := db.QueryRow(`
+		SELECT u.quota - COALESCE(SUM(f.size), 0)
+		FROM user u
+		LEFT JOIN file f
+		ON f.owner_id = u.id
+		WHERE u.id = ?
+		GROUP BY u.id
+	`, userid)
+
+	var remaining sql.NullInt64
+	err := row.Scan(&remaining)
+	return remaining, err
+}
+
+// checkQuota returns errQuota if storing another n bytes would exceed the
+// quota of a user.
+func checkQuota(db *sql.DB, userid interface{}, n int64) error {
+	remaining, err := remainingQuota(db, userid)
+	if err != nil {
+		return err
+	}
+
+	if remaining.Valid && n > remaining.Int64 {
+		return errQuota
+	}
+
+	return nil
+}
@@ -1,22 +1,60 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func remove(uuid string, data string, db *sql.DB) {
-	log.Printf("Deleting %s", uuid)
-
+// removeData deletes the contents of a file and its thumbnail.
+func removeData(uuid string, data string) {
 	if err := os.Remove(filepath.Join(data, uuid)); err != nil && !errors.Is(err, os.ErrNotExist) {
 		log.Fatalf("Unable to remove file with UUID %s: %s", uuid, err.Error())
 	}
 
+	if err := os.Remove(thumbnailPath(data, uuid)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Unable to remove thumbnail of %s: %s", uuid, err.Error())
+	}
+}
+
+func remove(uuid string, data string, db *sql.DB) {
+	log.Printf("Deleting %s", uuid)
+
+	removeData(uuid, data)
+
 	_, err := db.Exec(`
+		DELETE FROM share
+		WHERE file_uuid = ?
+	`, uuid)
+	if err != nil {
+		log.Fatalf("Unable to delete shares from database: %s", err.Error())
+	}
+
+	_, err = db.Exec(`
+		DELETE FROM collection_file
+		WHERE file_uuid = ?
+	`, uuid)
+	if err != nil {
+		log.Fatalf("Unable to delete collection entries from database: %s", err.Error())
+	}
+
+	_, err = db.Exec(`
+		DELETE FROM alias
+		WHERE file_uuid = ?
+	`, uuid)
+	if err != nil {
+		log.Fatalf("Unable to delete aliases from database: %s", err.Error())
+	}
+
+	_, err = db.Exec(`
 		DELETE FROM file
 		WHERE uuid = ?
 	`, uuid)
@@ -25,6 +63,96 @@ func remove(uuid string, data string, db *sql.DB) {
 	}
 }
 
+// nullBool turns an optional input into a value for the database.
+func nullBool(b *bool) sql.NullBool {
+	if b == nil {
+		return sql.NullBool{}
+	}
+	return sql.NullBool{
+		Bool:  *b,
+		Valid: true,
+	}
+}
+
+// countDownload records a download of a file, made through a link unless the
+// link is empty, unless the download limit of either has been reached. It also
+// reports whether this was the last allowed download of the file. Links are
+// removed once they have been used up.
+func countDownload(db *sql.DB, uuid string, link string) (bool, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, false, err
+	}
+	defer tx.Rollback()
+
+	allowed, last, err := recordDownload(tx, uuid, link)
+	if err != nil || !allowed {
+		return false, false, err
+	}
+
+	return true, last, tx.Commit()
+}
+
+// recordDownload counts a download like countDownload as part of a
+// transaction, which is left to the caller to commit.
+func recordDownload(tx *sql.Tx, uuid string, link string) (bool, bool, error) {
+	if link != "" {
+		res, err := tx.Exec(`
+			UPDATE alias
+			SET downloads = downloads + 1
+			WHERE name = ?
+			AND file_uuid = ?
+			AND (max_downloads IS NULL OR downloads < max_downloads)
+		`, link, uuid)
+		if err != nil {
+			return false, false, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil || n == 0 {
+			return false, false, err
+		}
+
+		_, err = tx.Exec(`
+			DELETE FROM alias
+			WHERE name = ?
+			AND max_downloads IS NOT NULL
+			AND downloads >= max_downloads
+		`, link)
+		if err != nil {
+			return false, false, err
+		}
+	}
+
+	res, err := tx.Exec(`
+		UPDATE file
+		SET downloads = downloads + 1
+		WHERE uuid = ?
+		AND (max_downloads IS NULL OR downloads < max_downloads)
+	`, uuid)
+	if err != nil {
+		return false, false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, false, err
+	}
+
+	row := tx.QueryRow(`
+		SELECT max_downloads IS NOT NULL AND downloads >= max_downloads
+		FROM file
+		WHERE uuid = ?
+	`, uuid)
+
+	var last bool
+	if err := row.Scan(&last); err != nil {
+		return false, false, err
+	}
+
+	return true, last, nil
+}
+
 func watch(uuid string, expiry time.Time, data string, db *sql.DB) {
 	log.Printf("Watching %s", uuid)
 
@@ -33,7 +161,168 @@ func watch(uuid string, expiry time.Time, data string, db *sql.DB) {
 		remove(uuid, data, db)
 	} else {
 		time.AfterFunc(time.Duration(diff)*time.Second, func() {
-			remove(uuid, data, db)
+			expire(uuid, data, db)
+		})
+	}
+}
+
+// expire removes a file once its expiry has been reached, taking into account
+// that the expiry might have been extended in the meantime.
+func expire(uuid string, data string, db *sql.DB) {
+	row := db.QueryRow(`
+		SELECT expiry
+		FROM file
+		WHERE uuid = ?
+	`, uuid)
+
+	var expiry int64
+	if err := row.Scan(&expiry); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Could not get expiry from database: %s", err.Error())
+		}
+		return
+	}
+
+	watch(uuid, time.Unix(expiry, 0), data, db)
+}
+
+// removeCollection deletes a collection, but not its files.
+func removeCollection(uuid string, db *sql.DB) {
+	log.Printf("Deleting collection %s", uuid)
+
+	_, err := db.Exec(`
+		DELETE FROM collection_file
+		WHERE collection_uuid = ?
+	`, uuid)
+	if err != nil {
+		log.Fatalf("Unable to delete collection entries from database: %s", err.Error())
+	}
+
+	_, err = db.Exec(`
+		DELETE FROM collection
+		WHERE uuid = ?
+	`, uuid)
+	if err != nil {
+		log.Fatalf("Unable to delete collection from database: %s", err.Error())
+	}
+}
+
+func watchCollection(uuid string, expiry time.Time, db *sql.DB) {
+	diff := expiry.Unix() - time.Now().Unix()
+	if diff <= 0 {
+		removeCollection(uuid, db)
+	} else {
+		time.AfterFunc(time.Duration(diff)*time.Second, func() {
+			row := db.QueryRow(`
+				SELECT expiry
+				FROM collection
+				WHERE uuid = ?
+			`, uuid)
+
+			var expiry int64
+			if err := row.Scan(&expiry); err != nil {
+				return
+			}
+
+			watchCollection(uuid, time.Unix(expiry, 0), db)
 		})
 	}
 }
+
+func asUnit(unit string, d time.Duration) (time.Duration, error) {
+	switch unit {
+	case "days":
+		return d * 24 * time.Hour, nil
+	case "hours":
+		return d * time.Hour, nil
+	case "minutes":
+		return d * time.Minute, nil
+	case "seconds":
+		return d * time.Second, nil
+	default:
+		return time.Duration(0), errors.New("invalid unit")
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// provision returns the user linked to an external identity, creating the user
+// on first login.
+func provision(db *sql.DB, provider string, subject string, name string) (int, error) {
+	row := db.QueryRow(`
+		SELECT id
+		FROM user
+		WHERE provider = ?
+		AND subject = ?
+	`, provider, subject)
+
+	var userid int
+	err := row.Scan(&userid)
+	if err == nil {
+		return userid, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	if name == "" {
+		return 0, errors.New("no user name provided")
+	}
+
+	// External users have no local password, so they cannot use the password form.
+	res, err := db.Exec(`
+		INSERT INTO user (name, password, provider, subject)
+		VALUES (?, '', ?, ?)
+	`, name, provider, subject)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create user %s: %w", name, err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Provisioned user %s for %s subject %s", name, provider, subject)
+
+	return int(id), nil
+}
+
+var sizeUnits = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+// parseSize understands sizes like 500, 20K, 1.5G or 10MiB, where the units
+// are powers of 1024.
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B"), "I")
+
+	shift := 0
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		shift = 10 * (strings.IndexByte("KMGT", s[i]) + 1)
+		s = s[:i]
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+
+	return int64(n * float64(int64(1)<<shift)), nil
+}
+
+func formatSize(n int64) string {
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(sizeUnits)-1 {
+		f /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%d %s", n, sizeUnits[i])
+	}
+
+	return fmt.Sprintf("%.1f %s", f, sizeUnits[i])
+}
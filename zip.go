@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+type zipEntry struct {
+	UUID     string
+	Name     string
+	Password bool
+}
+
+// accessible leaves out the files which are protected by a password, unless
+// the user may manage them.
+func accessible(db *sql.DB, entries []zipEntry, userid interface{}) ([]zipEntry, error) {
+	var kept []zipEntry
+	for _, e := range entries {
+		if e.Password {
+			permission, err := access(db, e.UUID, userid)
+			if err != nil {
+				return nil, err
+			}
+			if !canManage(permission) {
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	return kept, nil
+}
+
+// countEntries counts a download of every file in an archive, unless one of
+// them cannot be downloaded anymore, in which case none of them are counted. It
+// returns the files which have been downloaded for the last time.
+func countEntries(db *sql.DB, entries []zipEntry) ([]string, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	var used []string
+	for _, e := range entries {
+		allowed, last, err := recordDownload(tx, e.UUID, "")
+		if err != nil || !allowed {
+			return nil, false, err
+		}
+		if last {
+			used = append(used, e.UUID)
+		}
+	}
+
+	return used, true, tx.Commit()
+}
+
+// writeZip streams the given files into a zip archive. Files with the same
+// name are numbered, so that none of them are overwritten when extracting.
+func writeZip(w io.Writer, data string, entries []zipEntry) error {
+	zw := zip.NewWriter(w)
+
+	seen := map[string]int{}
+	for _, e := range entries {
+		name := path.Clean("/" + strings.ReplaceAll(e.Name, "\\", "/"))[1:]
+		if name == "" {
+			name = e.UUID
+		}
+
+		seen[name]++
+		if n := seen[name]; n > 1 {
+			ext := path.Ext(name)
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+		}
+
+		if err := addToZip(zw, filepath.Join(data, e.UUID), name); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func addToZip(zw *zip.Writer, src string, name string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	modified := time.Now()
+	if info, err := file.Stat(); err == nil {
+		modified = info.ModTime()
+	}
+
+	dst, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, file)
+	return err
+}
+
+// sendZip answers a request with a zip archive, which is built while it is
+// being sent. Each file in it counts as downloaded, and the archive is refused
+// if any of them has no downloads left.
+func sendZip(ctx *gin.Context, db *sql.DB, data string, name string, entries []zipEntry) bool {
+	used, allowed, err := countEntries(db, entries)
+	if err != nil {
+		log.Printf("Unable to count download: %s", err.Error())
+		ctx.AbortWithStatus(500)
+		return true
+	}
+	if !allowed {
+		return false
+	}
+
+	// Files are gone once they have been downloaded as often as allowed.
+	defer func() {
+		for _, fileuuid := range used {
+			remove(fileuuid, data, db)
+		}
+	}()
+
+	ctx.Header("Content-Type", "application/zip")
+	ctx.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": name + ".zip",
+	}))
+	ctx.Status(200)
+
+	// The status has already been sent, so errors can only be logged.
+	if err := writeZip(ctx.Writer, data, entries); err != nil {
+		log.Printf("Unable to write zip archive: %s", err.Error())
+	}
+
+	return true
+}
+
+func registerZip(priv *gin.RouterGroup, db *sql.DB, c config, t *throttle) {
+	// Zip the selected files, all of which the current user needs to have
+	// access to. Files with a password can only be included by those who may
+	// manage them.
+	priv.POST("/zip", func(ctx *gin.Context) {
+		userid := sessions.Default(ctx).Get("user_id")
+
+		var entries []zipEntry
+		selected := map[string]bool{}
+		for _, fileuuid := range ctx.PostFormArray("file") {
+			if selected[fileuuid] {
+				continue
+			}
+			selected[fileuuid] = true
+
+			permission, err := access(db, fileuuid, userid)
+			if err != nil {
+				log.Printf("Unable to check access: %s", err.Error())
+				ctx.AbortWithStatus(500)
+				return
+			}
+			if permission == "" {
+				ctx.Redirect(http.StatusFound, "/files/")
+				return
+			}
+
+			row := db.QueryRow(`
+				SELECT name, password IS NOT NULL
+				FROM file
+				WHERE uuid = ?
+			`, fileuuid)
+
+			e := zipEntry{UUID: fileuuid}
+			if err := row.Scan(&e.Name, &e.Password); err != nil {
+				log.Printf("Could not copy values from database: %s", err.Error())
+				ctx.Redirect(http.StatusFound, "/files/")
+				return
+			}
+			if e.Password && !canManage(permission) {
+				ctx.Redirect(http.StatusFound, "/files/")
+				return
+			}
+			entries = append(entries, e)
+		}
+
+		if len(entries) == 0 {
+			ctx.Redirect(http.StatusFound, "/files/")
+			return
+		}
+
+		done, ok := t.begin(ctx, "")
+		if !ok {
+			return
+		}
+		defer done()
+
+		if !sendZip(ctx, db, c.Data, "files", entries) {
+			ctx.Redirect(http.StatusFound, "/files/")
+		}
+	})
+}